@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/design-db-practice/datastore"
+)
+
+// handleBackup serves GET /admin/backup with a tar archive of the
+// database, as written by datastore.Db.Backup.
+func handleBackup(db *datastore.Db, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := fmt.Sprintf("db-backup-%s.tar", time.Now().UTC().Format("20060102-150405"))
+	archive := &archiveWriter{w: w, name: name}
+	err := db.Backup(archive)
+	switch {
+	case err == nil:
+	case archive.started:
+		// The status is already sent; the archive lacks its manifest, so
+		// restoring it fails.
+		fmt.Printf("Backup failed: %v\n", err)
+	case errors.Is(err, datastore.ErrReadOnly):
+		w.WriteHeader(http.StatusConflict)
+	default:
+		fmt.Printf("Backup failed: %v\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// archiveWriter sends the archive headers with the first bytes of a
+// backup, so that a backup that fails before it starts can still get an
+// error status.
+type archiveWriter struct {
+	w       http.ResponseWriter
+	name    string
+	started bool
+}
+
+func (a *archiveWriter) Write(p []byte) (int, error) {
+	if !a.started {
+		a.started = true
+		a.w.Header().Set("Content-Type", "application/x-tar")
+		a.w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", a.name))
+	}
+	return a.w.Write(p)
+}
+
+// runRestore implements "db restore [-dir path] [archive]", which rebuilds
+// a database directory from a backup while the server is stopped. The
+// archive is read from stdin if it is omitted or "-".
+func runRestore(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dir := fs.String("dir", envOr("DB_PATH", "/data"), "database directory to restore into")
+	fs.Parse(args)
+
+	var in io.Reader = os.Stdin
+	if path := fs.Arg(0); path != "" && path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			fmt.Printf("Failed to open backup: %v\n", err)
+			return 1
+		}
+		defer f.Close()
+		in = f
+	}
+
+	if err := datastore.Restore(in, *dir); err != nil {
+		fmt.Printf("Failed to restore database: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Database restored into %s\n", *dir)
+	return 0
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/design-db-practice/datastore"
+)
+
+func TestHandleBackup(t *testing.T) {
+	dir := t.TempDir()
+	db, err := datastore.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	backup := func(db *datastore.Db) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handleBackup(db, rec, httptest.NewRequest(http.MethodGet, "/admin/backup", nil))
+		return rec
+	}
+	if rec := backup(db); rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-tar" || rec.Body.Len() == 0 {
+		t.Errorf("backup responded %d %q with %d bytes, want an archive", rec.Code, rec.Header().Get("Content-Type"), rec.Body.Len())
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rec := backup(db); rec.Code != http.StatusInternalServerError || rec.Header().Get("Content-Type") == "application/x-tar" {
+		t.Errorf("backup of a closed database responded %d %q, want 500", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	readOnly, err := datastore.OpenWithOptions(dir, datastore.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnly.Close()
+	if rec := backup(readOnly); rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+		t.Errorf("backup of a read-only database responded %d with %d bytes, want an archive", rec.Code, rec.Body.Len())
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/roman-mazur/architecture-practice-4-template/design-db-practice/datastore"
+)
+
+// batchKey is the path under /db/ that accepts write batches.
+const batchKey = "_batch"
+
+type batchOperation struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// handleBatch applies a JSON array of put and delete operations atomically.
+func handleBatch(db *datastore.Db, replicas *replicaSet, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var operations []batchOperation
+	if err := json.NewDecoder(r.Body).Decode(&operations); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var batch datastore.WriteBatch
+	for _, op := range operations {
+		if op.Key == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch op.Op {
+		case "put":
+			batch.Put(op.Key, op.Value)
+		case "delete":
+			batch.Delete(op.Key)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := db.Write(&batch); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !replicas.confirm(db, w, r) {
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/roman-mazur/architecture-practice-4-template/design-db-practice/datastore"
+)
+
+// formatETag turns a key version into a strong entity tag.
+func formatETag(version uint64) string {
+	return fmt.Sprintf("%q", strconv.FormatUint(version, 10))
+}
+
+// parseETag returns the version in an entity tag. Weak tags are accepted,
+// since versions identify the value exactly either way.
+func parseETag(tag string) (uint64, error) {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	unquoted, err := strconv.Unquote(tag)
+	if err != nil {
+		return 0, fmt.Errorf("bad entity tag %s", tag)
+	}
+	return strconv.ParseUint(unquoted, 10, 64)
+}
+
+// writeCondition builds the datastore condition for the If-Match and
+// If-None-Match headers of a write. It returns nil if there are none.
+func writeCondition(r *http.Request) (*datastore.Condition, error) {
+	ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+	if ifMatch != "" && ifNoneMatch != "" {
+		return nil, fmt.Errorf("If-Match and If-None-Match cannot be combined")
+	}
+
+	var cond datastore.Condition
+	switch {
+	case ifMatch == "*":
+		cond = datastore.IfExists()
+	case ifMatch != "":
+		version, err := parseETag(ifMatch)
+		if err != nil {
+			return nil, err
+		}
+		cond = datastore.IfVersion(version)
+	case ifNoneMatch == "*":
+		cond = datastore.IfMissing()
+	case ifNoneMatch != "":
+		version, err := parseETag(ifNoneMatch)
+		if err != nil {
+			return nil, err
+		}
+		cond = datastore.IfNotVersion(version)
+	default:
+		return nil, nil
+	}
+	return &cond, nil
+}
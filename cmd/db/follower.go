@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/design-db-practice/datastore"
+)
+
+// replicaStateFile keeps the leader log position a follower has applied up
+// to, next to its segments.
+const replicaStateFile = "replica.json"
+
+// ackInterval is how often a follower that is not caught up reports its
+// progress to the leader.
+const ackInterval = 100 * time.Millisecond
+
+// bootstrapAttempts is how many times a new follower retries fetching the
+// initial backup from the leader, a second apart.
+const bootstrapAttempts = 30
+
+// errLogGone means the leader cannot continue from the position of the
+// follower. The follower has to be rebuilt from an empty directory.
+var errLogGone = errors.New("leader log no longer has the position of this follower; remove its data to resync")
+
+type replicaState struct {
+	Leader   string                `json:"leader"`
+	Position datastore.LogPosition `json:"position"`
+}
+
+// follower applies the log of a leader to a local database. Records are
+// applied at least once: after a restart the follower may apply again
+// what it applied after the state was last saved, which leaves the same
+// data behind.
+type follower struct {
+	db     *datastore.Db
+	dir    string
+	leader string
+	id     string
+	client *http.Client
+
+	mu        sync.Mutex
+	position  datastore.LogPosition
+	leaderEnd datastore.LogPosition
+	caughtUp  bool
+	// lastCaughtUp is when the follower last had every leader write.
+	lastCaughtUp time.Time
+	err          error
+}
+
+// prepareFollower returns the leader log position the database in dir
+// continues from. An empty directory is first filled from a backup of the
+// leader.
+func prepareFollower(dir, leader string) (datastore.LogPosition, error) {
+	data, err := os.ReadFile(filepath.Join(dir, replicaStateFile))
+	if err == nil {
+		var state replicaState
+		if err := json.Unmarshal(data, &state); err != nil {
+			return datastore.LogPosition{}, fmt.Errorf("bad %s: %w", replicaStateFile, err)
+		}
+		return state.Position, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return datastore.LogPosition{}, err
+	}
+
+	// The leader may still be starting up.
+	var resp *http.Response
+	for attempt := 0; ; attempt++ {
+		resp, err = http.Get(leader + "/admin/backup")
+		if err == nil || attempt == bootstrapAttempts {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		return datastore.LogPosition{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return datastore.LogPosition{}, fmt.Errorf("leader backup failed: %s", resp.Status)
+	}
+	pos, err := datastore.RestoreReplica(resp.Body, dir)
+	if err != nil {
+		return datastore.LogPosition{}, err
+	}
+	return pos, saveReplicaState(dir, replicaState{Leader: leader, Position: pos})
+}
+
+func saveReplicaState(dir string, state replicaState) error {
+	return writeStateFile(filepath.Join(dir, replicaStateFile), state)
+}
+
+// writeStateFile replaces the JSON file at path with v, so that a crash
+// leaves either the old or the new state behind.
+func writeStateFile(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func newFollower(db *datastore.Db, dir, leader, id string, pos datastore.LogPosition) *follower {
+	return &follower{
+		db:       db,
+		dir:      dir,
+		leader:   leader,
+		id:       id,
+		client:   &http.Client{Timeout: logStreamWait + 10*time.Second},
+		position: pos,
+	}
+}
+
+// run keeps the follower streaming from the leader until the leader can
+// no longer serve it.
+func (f *follower) run() {
+	for {
+		err := f.stream()
+		f.mu.Lock()
+		f.err = err
+		f.caughtUp = f.caughtUp && err == nil
+		f.mu.Unlock()
+		if errors.Is(err, errLogGone) {
+			fmt.Printf("Replication stopped: %v\n", err)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Replication from %s failed: %v\n", f.leader, err)
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+// stream applies one GET /repl/log response.
+func (f *follower) stream() error {
+	f.mu.Lock()
+	pos := f.position
+	f.mu.Unlock()
+
+	resp, err := f.client.Get(f.leader + "/repl/log?from=" + url.QueryEscape(pos.String()))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return errLogGone
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader responded %s", resp.Status)
+	}
+	if end, err := datastore.ParseLogPosition(resp.Header.Get(logEndHeader)); err == nil {
+		f.mu.Lock()
+		f.leaderEnd = end
+		f.mu.Unlock()
+	}
+
+	body := bufio.NewReader(resp.Body)
+	lastAck := time.Now()
+	for {
+		var sizeBuf [4]byte
+		if _, err := io.ReadFull(body, sizeBuf[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return f.report()
+			}
+			return err
+		}
+
+		size := binary.LittleEndian.Uint32(sizeBuf[:])
+		if size == 0 {
+			frame := make([]byte, positionFrameSize-4)
+			if _, err := io.ReadFull(body, frame); err != nil {
+				return err
+			}
+			next, caughtUp := decodePositionFrame(frame)
+			f.mu.Lock()
+			f.position = next
+			if caughtUp {
+				f.caughtUp, f.lastCaughtUp, f.leaderEnd = true, time.Now(), next
+			}
+			f.mu.Unlock()
+			if caughtUp {
+				if err := f.report(); err != nil {
+					return err
+				}
+				lastAck = time.Now()
+			}
+			continue
+		}
+
+		// The record is passed on as it is read, so that a large value is
+		// not held in memory.
+		record := io.MultiReader(bytes.NewReader(sizeBuf[:]), io.LimitReader(body, int64(size)-4))
+		if err := f.db.ApplyStream(record, int64(size)); err != nil {
+			return err
+		}
+		f.mu.Lock()
+		f.position.Offset += int64(size)
+		f.caughtUp = false
+		f.mu.Unlock()
+
+		if time.Since(lastAck) >= ackInterval {
+			if err := f.report(); err != nil {
+				return err
+			}
+			lastAck = time.Now()
+		}
+	}
+}
+
+// report saves the position of the follower and acknowledges it to the
+// leader.
+func (f *follower) report() error {
+	f.mu.Lock()
+	pos := f.position
+	f.mu.Unlock()
+
+	if err := saveReplicaState(f.dir, replicaState{Leader: f.leader, Position: pos}); err != nil {
+		return err
+	}
+	data, err := json.Marshal(ackRequest{Replica: f.id, Position: pos})
+	if err != nil {
+		return err
+	}
+	resp, err := f.client.Post(f.leader+"/repl/ack", "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("leader rejected ack: %s", resp.Status)
+	}
+	return nil
+}
+
+// handleStatus serves GET /admin/replication on a follower. lag is how
+// long ago the follower last had every write of the leader, zero while it
+// does and missing before it first caught up.
+func (f *follower) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	f.mu.Lock()
+	response := struct {
+		Role      string                `json:"role"`
+		Leader    string                `json:"leader"`
+		Position  datastore.LogPosition `json:"position"`
+		LeaderEnd datastore.LogPosition `json:"leader_end"`
+		CaughtUp  bool                  `json:"caught_up"`
+		Lag       string                `json:"lag,omitempty"`
+		Error     string                `json:"error,omitempty"`
+	}{
+		Role:      "follower",
+		Leader:    f.leader,
+		Position:  f.position,
+		LeaderEnd: f.leaderEnd,
+		CaughtUp:  f.caughtUp,
+	}
+	if f.caughtUp {
+		response.Lag = "0s"
+	} else if !f.lastCaughtUp.IsZero() {
+		response.Lag = time.Since(f.lastCaughtUp).Truncate(time.Millisecond).String()
+	}
+	if f.err != nil {
+		response.Error = f.err.Error()
+	}
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
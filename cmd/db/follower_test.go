@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/design-db-practice/datastore"
+)
+
+func TestFollowerPosition(t *testing.T) {
+	leader, err := datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = leader.Close()
+	})
+	put := func(value string) {
+		for i := 0; i < 5; i++ {
+			if err := leader.Put(fmt.Sprintf("key%d", i), value); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put("before")
+
+	replicas, err := newReplicaSet(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/backup", func(w http.ResponseWriter, r *http.Request) {
+		handleBackup(leader, w, r)
+	})
+	mux.HandleFunc("/repl/ack", replicas.handleAck)
+	mux.HandleFunc("/repl/log", func(w http.ResponseWriter, r *http.Request) {
+		// The stream ends without waiting for new writes, and it is cut
+		// before its caught up frame, so the follower has to count the
+		// position from the records alone.
+		ctx, cancel := context.WithCancel(r.Context())
+		cancel()
+		rec := httptest.NewRecorder()
+		handleLogStream(leader, rec, r.WithContext(ctx))
+		body := rec.Body.Bytes()
+		if rec.Code != http.StatusOK || len(body) < positionFrameSize {
+			w.WriteHeader(rec.Code)
+			return
+		}
+		w.Write(body[:len(body)-positionFrameSize])
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	dir := t.TempDir()
+	pos, err := prepareFollower(dir, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := datastore.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	put("after")
+
+	check := func(f *follower, value string) {
+		t.Helper()
+		if err := f.stream(); err != nil {
+			t.Fatal(err)
+		}
+		want := leader.LogEnd()
+		if f.position != want {
+			t.Errorf("follower is at %v, leader log ends at %v", f.position, want)
+		}
+		replicas.mu.Lock()
+		acked := replicas.replicas[f.id].Position
+		replicas.mu.Unlock()
+		if acked != want {
+			t.Errorf("follower acked %v, leader log ends at %v", acked, want)
+		}
+		saved, err := prepareFollower(dir, server.URL)
+		if err != nil || saved != want {
+			t.Errorf("saved position = %v, %v, want %v", saved, err, want)
+		}
+		if got, err := db.Get("key4"); err != nil || got != value {
+			t.Errorf("follower has key4 = %q, %v, want %q", got, err, value)
+		}
+	}
+	check(newFollower(db, dir, server.URL, "replica", pos), "after")
+
+	// A follower may still have saved the start of a segment from before
+	// the header was skipped in backups.
+	put("again")
+	check(newFollower(db, dir, server.URL, "old-replica", datastore.LogPosition{Segment: pos.Segment}), "again")
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/roman-mazur/architecture-practice-4-template/design-db-practice/datastore"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+type listItem struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// handleList serves GET /db/?prefix=...&limit=...&after=... . The response
+// carries "next" when more keys follow; passing it back as "after" fetches
+// the next page.
+func handleList(db *datastore.Db, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	limit := defaultListLimit
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxListLimit)
+	}
+
+	// Watching from this sequence number picks up where the list ends.
+	// It may be a little behind the list, which only repeats changes.
+	seq := db.LastSeq()
+	it := db.ScanPrefix(prefix)
+	if after := query.Get("after"); after != "" {
+		// The smallest key greater than after.
+		it.Seek(after + "\x00")
+	}
+
+	response := struct {
+		Items []listItem `json:"items"`
+		Next  string     `json:"next,omitempty"`
+	}{Items: []listItem{}}
+	for it.Next() {
+		if len(response.Items) == limit {
+			response.Next = response.Items[limit-1].Key
+			break
+		}
+		response.Items = append(response.Items, listItem{Key: it.Key(), Value: it.Value()})
+	}
+	if err := it.Err(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("X-Seq", strconv.FormatUint(seq, 10))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -1,68 +1,263 @@
 package main
 
 import (
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
 
 	"github.com/roman-mazur/architecture-practice-4-template/design-db-practice/datastore"
 )
 
+var (
+	dbPath         = flag.String("dir", envOr("DB_PATH", "/data"), "database directory")
+	segmentSize    = flag.Int64("segment-size", envInt64("DB_SEGMENT_SIZE", 0), "segment size in bytes (0 for the default)")
+	mergeThreshold = flag.Int("merge-threshold", int(envInt64("DB_MERGE_THRESHOLD", 0)), "segment count that triggers a merge (0 for the default)")
+	compaction     = flag.String("compaction", envOr("DB_COMPACTION", "count"), "which segments are merged: count (all past -merge-threshold) or dead-ratio (those past -dead-ratio)")
+	deadRatio      = flag.Float64("dead-ratio", envFloat("DB_DEAD_RATIO", 0.5), "share of reclaimable bytes from which -compaction=dead-ratio merges a segment")
+	window         = flag.String("compaction-window", envOr("DB_COMPACTION_WINDOW", ""), "local time of day merges run in, as HH:MM-HH:MM (empty for any time)")
+	writeQueue     = flag.Int("write-queue", int(envInt64("DB_WRITE_QUEUE", 0)), "number of pending writes before Put blocks (0 for the default)")
+	fileMode       = flag.String("file-mode", envOr("DB_FILE_MODE", "0600"), "permissions of database files, in octal")
+	syncMode       = flag.String("sync", envOr("DB_SYNC", "never"), "when to fsync writes: never, always or interval")
+	onCorruption   = flag.String("on-corruption", envOr("DB_ON_CORRUPTION", "fail"), "what to do with corrupt records found on load or merge: fail or skip")
+	syncInterval   = flag.Duration("sync-interval", envDuration("DB_SYNC_INTERVAL", time.Second), "fsync period for -sync=interval")
+	orderedIndex   = flag.Bool("ordered-index", envBool("DB_ORDERED_INDEX", false), "keep keys sorted in memory for faster listing")
+	readOnly       = flag.Bool("read-only", envBool("DB_READ_ONLY", false), "open the database for reading only, next to other read-only servers")
+	cacheSize      = flag.Int64("cache-size", envInt64("DB_CACHE_SIZE", 0), "bytes of memory for caching recently read values (0 disables the cache)")
+	keyFile        = flag.String("key-file", envOr("DB_KEY_FILE", ""), "file with hex encryption keys, one per line: the current one first, then older ones still to be read (overrides DB_ENCRYPTION_KEY)")
+	compressFrom   = flag.Int("compress-threshold", int(envInt64("DB_COMPRESS_THRESHOLD", 0)), "value size in bytes from which values are stored compressed (0 disables compression)")
+	watchHistory   = flag.Int("watch-history", int(envInt64("DB_WATCH_HISTORY", 0)), "recent changes kept for watchers to resume from (0 for the default)")
+	leaderURL      = flag.String("follow", envOr("DB_FOLLOW", ""), "URL of a leader to replicate; the server then only serves reads")
+	replicaID      = flag.String("replica-id", envOr("DB_REPLICA_ID", hostname()), "name a follower reports its progress to the leader under")
+	syncReplicas   = flag.Int("sync-replicas", int(envInt64("DB_SYNC_REPLICAS", 0)), "followers that must apply a write before the leader acknowledges it")
+	replicaTimeout = flag.Duration("replica-timeout", envDuration("DB_REPLICA_TIMEOUT", 5*time.Second), "how long a write waits for -sync-replicas followers")
+)
+
 func main() {
-	dbPath := os.Getenv("DB_PATH")
-	if dbPath == "" {
-		dbPath = "/data"
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		os.Exit(runRestore(os.Args[2:]))
+	}
+	flag.Parse()
+
+	opts, err := dbOptions()
+	if err != nil {
+		fmt.Printf("Invalid database options: %v\n", err)
+		os.Exit(1)
 	}
 
 	// Ensure database directory exists
-	if err := os.MkdirAll(filepath.Dir(dbPath), 0755); err != nil {
+	if err := os.MkdirAll(filepath.Dir(*dbPath), 0755); err != nil {
 		fmt.Printf("Failed to create database directory: %v\n", err)
 		os.Exit(1)
 	}
 
-	db, err := datastore.Open(dbPath)
+	var followFrom datastore.LogPosition
+	if *leaderURL != "" {
+		followFrom, err = prepareFollower(*dbPath, *leaderURL)
+		if err != nil {
+			fmt.Printf("Failed to set up follower: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	replicas, err := newReplicaSet(*dbPath)
+	if err != nil {
+		fmt.Printf("Failed to load followers: %v\n", err)
+		os.Exit(1)
+	}
+	if *leaderURL == "" {
+		// Merges must not take the log away from followers.
+		opts.LogRetention = replicas.retainFrom
+	}
+	db, err := datastore.OpenWithOptions(*dbPath, opts)
+	if errors.Is(err, datastore.ErrLocked) {
+		fmt.Printf("Failed to open database: another process is using %s\n", *dbPath)
+		os.Exit(1)
+	}
+	if errors.Is(err, datastore.ErrWrongKey) {
+		fmt.Printf("Failed to open database: the encryption key does not match the data (%v)\n", err)
+		os.Exit(1)
+	}
 	if err != nil {
 		fmt.Printf("Failed to open database: %v\n", err)
 		os.Exit(1)
 	}
 	defer db.Close()
+	if report := db.Recovery(); report != nil {
+		fmt.Printf("Repaired database after unclean shutdown: %s\n", report)
+	}
+	for _, corrupt := range db.SkippedRecords() {
+		fmt.Printf("Skipped %v\n", corrupt)
+	}
+
+	var fol *follower
+	if *leaderURL != "" {
+		fol = newFollower(db, *dbPath, *leaderURL, *replicaID, followFrom)
+		go fol.run()
+		http.HandleFunc("/admin/replication", fol.handleStatus)
+	} else {
+		http.HandleFunc("/repl/log", func(w http.ResponseWriter, r *http.Request) {
+			handleLogStream(db, w, r)
+		})
+		http.HandleFunc("/repl/ack", replicas.handleAck)
+		http.HandleFunc("/admin/replication", func(w http.ResponseWriter, r *http.Request) {
+			replicas.handleStatus(db, w, r)
+		})
+	}
+
+	http.HandleFunc("/admin/backup", func(w http.ResponseWriter, r *http.Request) {
+		if fol == nil && !*readOnly {
+			// A new follower continues from the end of the backup.
+			if err := replicas.pinBackup(db.LogEnd()); err != nil {
+				fmt.Printf("Failed to save the backup position: %v\n", err)
+			}
+		}
+		handleBackup(db, w, r)
+	})
+	http.HandleFunc("/admin/cache", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(db.CacheStats())
+	})
+
+	http.HandleFunc("/admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(db.Stats())
+	})
 
 	http.HandleFunc("/db/", func(w http.ResponseWriter, r *http.Request) {
 		key := r.URL.Path[len("/db/"):]
+		if (fol != nil || *readOnly) && r.Method != http.MethodGet {
+			// Followers only change through the leader log.
+			w.Header().Set("Allow", http.MethodGet)
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
 		if key == "" {
-			w.WriteHeader(http.StatusBadRequest)
+			handleList(db, w, r)
+			return
+		}
+		if key == batchKey {
+			handleBatch(db, replicas, w, r)
+			return
+		}
+		if key == watchKey {
+			handleWatch(db, w, r)
 			return
 		}
 
 		switch r.Method {
 		case http.MethodGet:
-			value, err := db.Get(key)
+			if acceptsRaw(r) {
+				handleGetRaw(db, key, w)
+				return
+			}
+			item, err := db.GetItem(key)
 			if err != nil {
 				w.WriteHeader(http.StatusNotFound)
 				return
 			}
 
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(map[string]string{
+			response := map[string]string{
 				"key":   key,
-				"value": value,
-			})
+				"value": item.Value,
+			}
+			if !item.ExpiresAt.IsZero() {
+				response["ttl"] = formatTTL(item.ExpiresAt)
+			}
+			w.Header().Set("ETag", formatETag(item.Version))
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(response)
 
 		case http.MethodPost:
 			var request struct {
 				Value string `json:"value"`
+				TTL   string `json:"ttl"`
+			}
+			raw := sendsRaw(r)
+			if !raw {
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
+			if ttlParam := r.URL.Query().Get("ttl"); ttlParam != "" {
+				request.TTL = ttlParam
 			}
-			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			ttl, err := parseTTL(request.TTL)
+			if err != nil {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
 
-			if err := db.Put(key, request.Value); err != nil {
+			cond, err := writeCondition(r)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			var version uint64
+			switch {
+			case raw:
+				version, err = putRaw(db, key, r, ttl, cond)
+			case cond == nil && ttl == 0:
+				err = db.Put(key, request.Value)
+			case cond == nil:
+				err = db.PutWithTTL(key, request.Value, ttl)
+			case ttl == 0:
+				version, err = db.PutIf(key, request.Value, *cond)
+			default:
+				version, err = db.PutIfWithTTL(key, request.Value, ttl, *cond)
+			}
+			if err == nil && cond != nil {
+				w.Header().Set("ETag", formatETag(version))
+			}
+			if err != nil {
+				if errors.Is(err, datastore.ErrConditionFailed) {
+					w.WriteHeader(http.StatusPreconditionFailed)
+					return
+				}
+				if errors.Is(err, io.ErrUnexpectedEOF) {
+					// The body was cut short.
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			if !replicas.confirm(db, w, r) {
+				return
+			}
+
+			w.WriteHeader(http.StatusOK)
+
+		case http.MethodDelete:
+			if err := db.Delete(key); err != nil {
+				if errors.Is(err, datastore.ErrNotFound) {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
 				w.WriteHeader(http.StatusInternalServerError)
 				return
 			}
+			if !replicas.confirm(db, w, r) {
+				return
+			}
 
 			w.WriteHeader(http.StatusOK)
 		default:
@@ -73,3 +268,166 @@ func main() {
 	fmt.Println("Database server started on :8083")
 	http.ListenAndServe(":8083", nil)
 }
+
+func dbOptions() (datastore.Options, error) {
+	mode, err := strconv.ParseUint(*fileMode, 8, 32)
+	if err != nil {
+		return datastore.Options{}, fmt.Errorf("bad file mode %q: %w", *fileMode, err)
+	}
+
+	opts := datastore.Options{
+		SegmentSize:    *segmentSize,
+		MergeThreshold: *mergeThreshold,
+		WriteQueueSize: *writeQueue,
+		FileMode:       os.FileMode(mode),
+		Sync:           datastore.SyncPolicy{Interval: *syncInterval},
+		OrderedIndex:   *orderedIndex,
+		ReadOnly:       *readOnly,
+		WatchHistory:   *watchHistory,
+		CacheSize:      *cacheSize,
+
+		CompressionThreshold: *compressFrom,
+	}
+	if opts.Compaction, err = compactionPolicy(); err != nil {
+		return datastore.Options{}, err
+	}
+	if *readOnly && *leaderURL != "" {
+		return datastore.Options{}, fmt.Errorf("a follower applies the leader log, so it cannot be read-only")
+	}
+	switch *syncMode {
+	case "never":
+		opts.Sync.Mode = datastore.SyncNever
+	case "always":
+		opts.Sync.Mode = datastore.SyncAlways
+	case "interval":
+		opts.Sync.Mode = datastore.SyncInterval
+	default:
+		return datastore.Options{}, fmt.Errorf("unknown sync mode %q", *syncMode)
+	}
+	switch *onCorruption {
+	case "fail":
+		opts.OnCorruption = datastore.CorruptionFail
+	case "skip":
+		opts.OnCorruption = datastore.CorruptionSkip
+	default:
+		return datastore.Options{}, fmt.Errorf("unknown corruption policy %q", *onCorruption)
+	}
+
+	keys, err := encryptionKeys()
+	if err != nil {
+		return datastore.Options{}, err
+	}
+	if len(keys) > 0 {
+		opts.EncryptionKey, opts.PreviousKeys = keys[0], keys[1:]
+	}
+	return opts, nil
+}
+
+// compactionPolicy builds the policy chosen by -compaction and
+// -compaction-window.
+func compactionPolicy() (datastore.CompactionPolicy, error) {
+	var policy datastore.CompactionPolicy
+	switch *compaction {
+	case "count":
+		threshold := *mergeThreshold
+		if threshold == 0 {
+			threshold = datastore.DefaultOptions().MergeThreshold
+		}
+		policy = datastore.SegmentCountPolicy{Threshold: threshold}
+	case "dead-ratio":
+		if *deadRatio <= 0 || *deadRatio > 1 {
+			return nil, fmt.Errorf("dead ratio must be in (0, 1], got %v", *deadRatio)
+		}
+		policy = datastore.DeadRatioPolicy{Ratio: *deadRatio}
+	default:
+		return nil, fmt.Errorf("unknown compaction policy %q", *compaction)
+	}
+	if *window == "" {
+		return policy, nil
+	}
+
+	from, to, ok := strings.Cut(*window, "-")
+	start, err := parseTimeOfDay(from)
+	if err == nil {
+		var end time.Duration
+		end, err = parseTimeOfDay(to)
+		if ok && err == nil {
+			return datastore.TimeWindowPolicy{Start: start, End: end, Policy: policy}, nil
+		}
+	}
+	return nil, fmt.Errorf("bad compaction window %q, want HH:MM-HH:MM", *window)
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// encryptionKeys reads the keys from -key-file, or else from the
+// DB_ENCRYPTION_KEY variable, which lists them separated by commas. Both
+// hold them hex encoded, the current key first.
+func encryptionKeys() ([][]byte, error) {
+	text := os.Getenv("DB_ENCRYPTION_KEY")
+	if *keyFile != "" {
+		data, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read key file: %w", err)
+		}
+		text = string(data)
+	}
+
+	var keys [][]byte
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		key, err := hex.DecodeString(field)
+		if err != nil {
+			return nil, fmt.Errorf("bad encryption key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func hostname() string {
+	if name, err := os.Hostname(); err == nil {
+		return name
+	}
+	return "replica"
+}
+
+func envOr(name, def string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return def
+}
+
+func envInt64(name string, def int64) int64 {
+	if value, err := strconv.ParseInt(os.Getenv(name), 10, 64); err == nil {
+		return value
+	}
+	return def
+}
+
+func envFloat(name string, def float64) float64 {
+	if value, err := strconv.ParseFloat(os.Getenv(name), 64); err == nil {
+		return value
+	}
+	return def
+}
+
+func envBool(name string, def bool) bool {
+	if value, err := strconv.ParseBool(os.Getenv(name)); err == nil {
+		return value
+	}
+	return def
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return value
+	}
+	return def
+}
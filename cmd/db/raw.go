@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/design-db-practice/datastore"
+)
+
+// octetStream is the content type of values sent and returned as they are,
+// instead of as a string in JSON.
+const octetStream = "application/octet-stream"
+
+// acceptsRaw tells whether the client asked for the value as raw bytes.
+func acceptsRaw(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mediaType != octetStream {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// sendsRaw tells whether the body of a write is the value as raw bytes.
+func sendsRaw(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == octetStream
+}
+
+// handleGetRaw returns the value of key as the body, streamed from the
+// database. What the JSON form has besides the value goes into headers:
+// the TTL into X-TTL.
+func handleGetRaw(db *datastore.Db, key string, w http.ResponseWriter) {
+	item, err := db.GetItemStream(key)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer item.Close()
+	w.Header().Set("ETag", formatETag(item.Version))
+	if !item.ExpiresAt.IsZero() {
+		w.Header().Set("X-TTL", formatTTL(item.ExpiresAt))
+	}
+	w.Header().Set("Content-Type", octetStream)
+	w.Header().Set("Content-Length", strconv.FormatInt(item.Size, 10))
+	// A value found damaged while it is sent cuts the response short,
+	// which the client sees against Content-Length.
+	io.Copy(w, item)
+}
+
+// putRaw streams the body of r into the database as the value of key.
+func putRaw(db *datastore.Db, key string, r *http.Request, ttl time.Duration, cond *datastore.Condition) (uint64, error) {
+	// ContentLength is -1 for chunked bodies, which PutStream reads to
+	// their end.
+	switch {
+	case cond == nil && ttl == 0:
+		return 0, db.PutStream(key, r.Body, r.ContentLength)
+	case cond == nil:
+		return 0, db.PutStreamWithTTL(key, r.Body, r.ContentLength, ttl)
+	case ttl == 0:
+		return db.PutStreamIf(key, r.Body, r.ContentLength, *cond)
+	default:
+		return db.PutStreamIfWithTTL(key, r.Body, r.ContentLength, ttl, *cond)
+	}
+}
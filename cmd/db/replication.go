@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/design-db-practice/datastore"
+)
+
+// logStreamWait is how long GET /repl/log waits for new writes before it
+// ends the response. The follower then asks again.
+const logStreamWait = 10 * time.Second
+
+// logEndHeader carries the end of the leader log when a stream starts.
+const logEndHeader = "X-Log-End"
+
+// The body of GET /repl/log is the records of the leader log, exactly as
+// they are stored, mixed with position frames:
+//
+//	(0 4) (segment 8) (offset 8) (caught up 1)
+//
+// A record never starts with a zero size, so the two cannot be confused.
+// A position frame tells where the next record starts. The leader sends
+// one when the log does not start at the requested position, one when it
+// moves on to another segment and one with the caught up flag whenever the
+// follower has received everything written so far.
+const positionFrameSize = 21
+
+func encodePositionFrame(pos datastore.LogPosition, caughtUp bool) []byte {
+	frame := make([]byte, 4, positionFrameSize)
+	frame = binary.LittleEndian.AppendUint64(frame, uint64(pos.Segment))
+	frame = binary.LittleEndian.AppendUint64(frame, uint64(pos.Offset))
+	if caughtUp {
+		return append(frame, 1)
+	}
+	return append(frame, 0)
+}
+
+// decodePositionFrame decodes a position frame without its zero size.
+func decodePositionFrame(frame []byte) (datastore.LogPosition, bool) {
+	pos := datastore.LogPosition{
+		Segment: int(binary.LittleEndian.Uint64(frame)),
+		Offset:  int64(binary.LittleEndian.Uint64(frame[8:])),
+	}
+	return pos, frame[16] != 0
+}
+
+// handleLogStream serves GET /repl/log?from=segment:offset to followers.
+// A position the leader cannot read from anymore gets 410 Gone.
+func handleLogStream(db *datastore.Db, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	from, err := datastore.ParseLogPosition(r.URL.Query().Get("from"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	reader, err := db.OpenLog(from)
+	if errors.Is(err, datastore.ErrLogUnavailable) {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(logEndHeader, db.LogEnd().String())
+	flusher, _ := w.(http.Flusher)
+
+	ctx, cancel := context.WithTimeout(r.Context(), logStreamWait)
+	defer cancel()
+	segment := from.Segment
+	if start := reader.Position(); start != from {
+		// The log does not start where the follower asked, for example at
+		// the header of a segment, so it has to be told where it does.
+		if _, err := w.Write(encodePositionFrame(start, false)); err != nil {
+			return
+		}
+	}
+	for {
+		record, size, err := reader.NextReader()
+		if errors.Is(err, io.EOF) {
+			if _, err := w.Write(encodePositionFrame(reader.Position(), true)); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			if reader.Wait(ctx) != nil {
+				return
+			}
+			continue
+		}
+		if err != nil {
+			// The follower sees the stream end early and asks again.
+			fmt.Printf("Replication stream from %v failed: %v\n", from, err)
+			return
+		}
+
+		if pos := reader.Position(); pos.Segment != segment {
+			segment = pos.Segment
+			pos.Offset -= size
+			if _, err := w.Write(encodePositionFrame(pos, false)); err != nil {
+				return
+			}
+		}
+		// Large records are copied from the segment without being held
+		// in memory.
+		if _, err := io.Copy(w, record); err != nil {
+			return
+		}
+	}
+}
+
+// replicaRetention is how long the leader keeps the log for a follower
+// that stopped acknowledging, and for one that was sent a backup to start
+// from. A follower away for longer has to be rebuilt.
+const replicaRetention = time.Hour
+
+// replicaSetFile keeps the progress of the followers of a leader next to
+// its segments, so that merges still leave them the log after a restart.
+const replicaSetFile = "followers.json"
+
+// replicaProgress is how far a follower has applied the leader log.
+type replicaProgress struct {
+	Position datastore.LogPosition `json:"position"`
+	Seen     time.Time             `json:"seen"`
+}
+
+// replicaSet tracks the followers of a leader from their acks.
+type replicaSet struct {
+	path     string
+	mu       sync.Mutex
+	replicas map[string]replicaProgress
+	// backups are the log positions of the backups sent out, which new
+	// followers continue from.
+	backups []replicaProgress
+	// changed is closed and replaced on every ack.
+	changed chan struct{}
+}
+
+// replicaSetState is the content of replicaSetFile.
+type replicaSetState struct {
+	Replicas map[string]replicaProgress `json:"replicas"`
+	Backups  []replicaProgress          `json:"backups"`
+}
+
+// newReplicaSet returns the followers saved in dir by an earlier run.
+func newReplicaSet(dir string) (*replicaSet, error) {
+	s := &replicaSet{
+		path:     filepath.Join(dir, replicaSetFile),
+		replicas: make(map[string]replicaProgress),
+		changed:  make(chan struct{}),
+	}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state replicaSetState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("bad %s: %w", replicaSetFile, err)
+	}
+	if state.Replicas != nil {
+		s.replicas = state.Replicas
+	}
+	s.backups = state.Backups
+	return s, nil
+}
+
+// save writes the followers to replicaSetFile. s.mu must be held.
+func (s *replicaSet) save() error {
+	return writeStateFile(s.path, replicaSetState{Replicas: s.replicas, Backups: s.backups})
+}
+
+func (s *replicaSet) ack(id string, pos datastore.LogPosition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	progress := s.replicas[id]
+	if pos.Compare(progress.Position) > 0 {
+		progress.Position = pos
+	}
+	progress.Seen = time.Now()
+	s.replicas[id] = progress
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return s.save()
+}
+
+// pinBackup keeps the log from pos on for a follower that starts from a
+// backup taken there.
+func (s *replicaSet) pinBackup(pos datastore.LogPosition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backups = append(s.backups, replicaProgress{Position: pos, Seen: time.Now()})
+	return s.save()
+}
+
+// retainFrom returns the oldest position followers may still read the log
+// from, for datastore.Options.LogRetention.
+func (s *replicaSet) retainFrom() (datastore.LogPosition, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backups = slices.DeleteFunc(s.backups, func(p replicaProgress) bool {
+		return time.Since(p.Seen) > replicaRetention
+	})
+	var from datastore.LogPosition
+	found := false
+	consider := func(p replicaProgress) {
+		if time.Since(p.Seen) <= replicaRetention && (!found || p.Position.Compare(from) < 0) {
+			from, found = p.Position, true
+		}
+	}
+	for _, p := range s.replicas {
+		consider(p)
+	}
+	for _, p := range s.backups {
+		consider(p)
+	}
+	return from, found
+}
+
+// waitFor blocks until n followers have applied the log up to pos.
+func (s *replicaSet) waitFor(ctx context.Context, pos datastore.LogPosition, n int) error {
+	for {
+		s.mu.Lock()
+		count := 0
+		for _, progress := range s.replicas {
+			if progress.Position.Compare(pos) >= 0 {
+				count++
+			}
+		}
+		changed := s.changed
+		s.mu.Unlock()
+		if count >= n {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// confirm waits for -sync-replicas followers to apply everything written
+// so far. If they do not within -replica-timeout, it responds with
+// 504 Gateway Timeout and returns false; the write itself stays applied on
+// the leader.
+func (s *replicaSet) confirm(db *datastore.Db, w http.ResponseWriter, r *http.Request) bool {
+	if *syncReplicas <= 0 {
+		return true
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), *replicaTimeout)
+	defer cancel()
+	if err := s.waitFor(ctx, db.LogEnd(), *syncReplicas); err != nil {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return false
+	}
+	return true
+}
+
+type ackRequest struct {
+	Replica  string                `json:"replica"`
+	Position datastore.LogPosition `json:"position"`
+}
+
+// handleAck serves POST /repl/ack, with which followers report how far
+// they have applied the log.
+func (s *replicaSet) handleAck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var request ackRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Replica == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := s.ack(request.Replica, request.Position); err != nil {
+		fmt.Printf("Failed to save the progress of %s: %v\n", request.Replica, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleStatus serves GET /admin/replication on the leader.
+func (s *replicaSet) handleStatus(db *datastore.Db, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.Lock()
+	replicas := maps.Clone(s.replicas)
+	s.mu.Unlock()
+
+	response := struct {
+		Role     string                     `json:"role"`
+		LogEnd   datastore.LogPosition      `json:"log_end"`
+		Replicas map[string]replicaProgress `json:"replicas"`
+	}{Role: "leader", LogEnd: db.LogEnd(), Replicas: replicas}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/roman-mazur/architecture-practice-4-template/design-db-practice/datastore"
+)
+
+func TestReplicaSetRestart(t *testing.T) {
+	dir := t.TempDir()
+	s, err := newReplicaSet(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.retainFrom(); ok {
+		t.Fatal("a new leader retains the log without followers")
+	}
+	backup := datastore.LogPosition{Segment: 2, Offset: 16}
+	if err := s.ack("replica", datastore.LogPosition{Segment: 3, Offset: 100}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.pinBackup(backup); err != nil {
+		t.Fatal(err)
+	}
+
+	// The leader restarts.
+	s, err = newReplicaSet(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from, ok := s.retainFrom(); !ok || from != backup {
+		t.Errorf("retainFrom after a restart = %v, %v, want %v", from, ok, backup)
+	}
+	if err := s.ack("replica", datastore.LogPosition{Segment: 1, Offset: 16}); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.replicas["replica"].Position; got != (datastore.LogPosition{Segment: 3, Offset: 100}) {
+		t.Errorf("replica is at %v after an older ack, want the saved position", got)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// parseTTL accepts a Go duration ("90s", "1h") or a number of seconds.
+// An empty string means no TTL.
+func parseTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		s = fmt.Sprintf("%ds", seconds)
+	}
+	ttl, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		return 0, fmt.Errorf("ttl must be positive, got %v", ttl)
+	}
+	return ttl, nil
+}
+
+// formatTTL reports the time left until expiresAt, rounded up to seconds.
+func formatTTL(expiresAt time.Time) string {
+	return (time.Until(expiresAt) + time.Second - 1).Truncate(time.Second).String()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/design-db-practice/datastore"
+)
+
+// watchKey is the path under /db/ that streams changes.
+const watchKey = "_watch"
+
+// watchKeepAlive is how often an idle watch stream gets a comment line, so
+// that proxies do not close it.
+const watchKeepAlive = 15 * time.Second
+
+type watchEvent struct {
+	Key     string `json:"key"`
+	Value   string `json:"value,omitempty"`
+	Version uint64 `json:"version,omitempty"`
+	// ValueOmitted is set for values too large to be sent along; the
+	// client reads them with a GET.
+	ValueOmitted bool `json:"value_omitted,omitempty"`
+}
+
+// handleWatch serves GET /db/_watch?prefix=... as Server-Sent Events. Every
+// event is a "put" or a "delete" with the sequence number of the write as
+// its id. A client resumes with the Last-Event-ID header or the "from"
+// parameter; without either it gets the changes made from now on. A client
+// that resumes from too far back gets 410 Gone, and a stream that falls
+// too far behind ends with an "error" event; the client then lists the
+// keys again and watches from the "X-Seq" header of the list.
+func handleWatch(db *datastore.Db, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	from := db.LastSeq()
+	resume := r.Header.Get("Last-Event-ID")
+	if resume == "" {
+		resume = r.URL.Query().Get("from")
+	}
+	if resume != "" {
+		seq, err := strconv.ParseUint(resume, 10, 64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		from = seq
+	}
+
+	watcher, err := db.Watch(r.URL.Query().Get("prefix"), from)
+	if errors.Is(err, datastore.ErrWatchGap) {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer watcher.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case c, ok := <-watcher.C:
+			if !ok {
+				if err := watcher.Err(); err != nil {
+					data, _ := json.Marshal(map[string]string{"error": err.Error()})
+					fmt.Fprintf(w, "event: error\ndata: %s\n\n", data)
+					flusher.Flush()
+				}
+				return
+			}
+			kind := "put"
+			if c.Deleted {
+				kind = "delete"
+			}
+			data, _ := json.Marshal(watchEvent{Key: c.Key, Value: c.Value, Version: c.Version, ValueOmitted: c.ValueOmitted})
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", c.Seq, kind, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
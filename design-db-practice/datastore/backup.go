@@ -0,0 +1,252 @@
+package datastore
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupManifestName is the last member of a backup archive. An archive
+// without it was cut short.
+const backupManifestName = "MANIFEST.json"
+
+const backupVersion = 1
+
+type backupManifest struct {
+	Version  int             `json:"version"`
+	Created  time.Time       `json:"created"`
+	Segments []backupSegment `json:"segments"`
+	// Log is where the log continues after the last archived segment.
+	Log LogPosition `json:"log"`
+}
+
+type backupSegment struct {
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	CRC32 uint32 `json:"crc32"`
+}
+
+// Backup writes a tar archive of the database to w while it keeps serving
+// reads and writes. The current segment is sealed first, so the archive
+// holds every write acknowledged before Backup was called. A read-only Db
+// cannot seal it, so its current segment is archived as far as it was
+// loaded.
+func (db *Db) Backup(w io.Writer) error {
+	readOnly := db.opts.ReadOnly
+	if !readOnly {
+		if err := db.submit(entryWithAck{seal: true}); err != nil {
+			return err
+		}
+	}
+
+	// Pinning the segments like a snapshot does keeps a merge from
+	// removing them while they are copied.
+	db.indexMutex.RLock()
+	if db.segments == nil {
+		db.indexMutex.RUnlock()
+		return errClosed
+	}
+	var sealed []*segment
+	// The log continues with the first record of the current segment.
+	log := LogPosition{Segment: db.currentID, Offset: segmentHeaderSize}
+	if readOnly {
+		log.Offset = db.currentOffset
+	}
+	for id, s := range db.segments {
+		if id < db.currentID || readOnly {
+			s.acquire()
+			sealed = append(sealed, s)
+		}
+	}
+	db.indexMutex.RUnlock()
+	defer func() {
+		for _, s := range sealed {
+			s.release()
+		}
+	}()
+	sort.Slice(sealed, func(i, j int) bool { return sealed[i].id < sealed[j].id })
+
+	tw := tar.NewWriter(w)
+	manifest := backupManifest{Version: backupVersion, Created: time.Now().UTC(), Log: log}
+	for _, s := range sealed {
+		info, err := s.file.Stat()
+		if err != nil {
+			return err
+		}
+		size := info.Size()
+		if s.id == log.Segment {
+			// A torn tail left out of a read-only Db is left out here too.
+			size = min(size, log.Offset)
+		}
+		name := fmt.Sprintf(segmentFileFormat, s.id)
+		err = tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    int64(db.opts.FileMode.Perm()),
+			Size:    size,
+			ModTime: info.ModTime(),
+		})
+		if err != nil {
+			return err
+		}
+		h := crc32.NewIEEE()
+		if _, err := io.Copy(io.MultiWriter(tw, h), io.NewSectionReader(s.file, 0, size)); err != nil {
+			return fmt.Errorf("cannot back up segment %d: %w", s.id, err)
+		}
+		manifest.Segments = append(manifest.Segments, backupSegment{Name: name, Size: size, CRC32: h.Sum32()})
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    backupManifestName,
+		Mode:    int64(db.opts.FileMode.Perm()),
+		Size:    int64(len(data)),
+		ModTime: manifest.Created,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Restore rebuilds a database in dir from an archive written by Backup.
+// dir is created if needed and must not hold a database already. Nothing
+// is left in dir unless the whole archive checks out against its manifest.
+// It fails with ErrLocked if a Db has dir open.
+func Restore(r io.Reader, dir string) error {
+	_, err := RestoreReplica(r, dir)
+	return err
+}
+
+// RestoreReplica is Restore that also returns the position in the log of
+// the backed up Db right after the restored data. A replica continues
+// from there with OpenLog.
+func RestoreReplica(r io.Reader, dir string) (pos LogPosition, err error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return LogPosition{}, err
+	}
+	lockPath := filepath.Join(dir, lockFileName)
+	_, statErr := os.Stat(lockPath)
+	lock, err := lockDir(dir, true, DefaultOptions().FileMode)
+	if err != nil {
+		return LogPosition{}, fmt.Errorf("restore: %w", err)
+	}
+	defer func() {
+		if err != nil && errors.Is(statErr, fs.ErrNotExist) {
+			os.Remove(lockPath)
+		}
+		lock.Close()
+	}()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return LogPosition{}, err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), "segment-") {
+			return LogPosition{}, fmt.Errorf("restore: %s already holds a database", dir)
+		}
+	}
+
+	restored := make(map[string]backupSegment)
+	defer func() {
+		for name := range restored {
+			os.Remove(filepath.Join(dir, name+".restore"))
+		}
+	}()
+
+	var manifest *backupManifest
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return LogPosition{}, fmt.Errorf("restore: %w", err)
+		}
+		if manifest != nil {
+			return LogPosition{}, fmt.Errorf("restore: %s follows the manifest", hdr.Name)
+		}
+		if hdr.Name == backupManifestName {
+			manifest = new(backupManifest)
+			if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+				return LogPosition{}, fmt.Errorf("restore: bad manifest: %w", err)
+			}
+			continue
+		}
+
+		var id int
+		if _, err := fmt.Sscanf(hdr.Name, segmentFileFormat, &id); err != nil || hdr.Name != fmt.Sprintf(segmentFileFormat, id) {
+			return LogPosition{}, fmt.Errorf("restore: unexpected file %q in archive", hdr.Name)
+		}
+		if _, ok := restored[hdr.Name]; ok {
+			return LogPosition{}, fmt.Errorf("restore: %s appears twice in archive", hdr.Name)
+		}
+		restored[hdr.Name] = backupSegment{}
+		seg, err := restoreFile(filepath.Join(dir, hdr.Name+".restore"), os.FileMode(hdr.Mode).Perm(), tr)
+		if err != nil {
+			return LogPosition{}, fmt.Errorf("restore: %s: %w", hdr.Name, err)
+		}
+		seg.Name = hdr.Name
+		restored[hdr.Name] = seg
+	}
+
+	if manifest == nil {
+		return LogPosition{}, fmt.Errorf("restore: archive has no manifest, it may be truncated")
+	}
+	if manifest.Version != backupVersion {
+		return LogPosition{}, fmt.Errorf("restore: unknown backup version %d", manifest.Version)
+	}
+	if len(manifest.Segments) != len(restored) {
+		return LogPosition{}, fmt.Errorf("restore: archive has %d segments, manifest lists %d", len(restored), len(manifest.Segments))
+	}
+	for _, want := range manifest.Segments {
+		if got, ok := restored[want.Name]; !ok || got != want {
+			return LogPosition{}, fmt.Errorf("restore: %s does not match the manifest", want.Name)
+		}
+	}
+
+	for name := range restored {
+		if err := os.Rename(filepath.Join(dir, name+".restore"), filepath.Join(dir, name)); err != nil {
+			return LogPosition{}, fmt.Errorf("restore: %w", err)
+		}
+	}
+	return manifest.Log, nil
+}
+
+// restoreFile copies r to a new file at path and returns its size and
+// checksum.
+func restoreFile(path string, perm os.FileMode, r io.Reader) (backupSegment, error) {
+	if perm == 0 {
+		perm = DefaultOptions().FileMode
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, perm)
+	if err != nil {
+		return backupSegment{}, err
+	}
+	defer f.Close()
+
+	h := crc32.NewIEEE()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return backupSegment{}, err
+	}
+	if err := f.Sync(); err != nil {
+		return backupSegment{}, err
+	}
+	return backupSegment{Size: n, CRC32: h.Sum32()}, f.Close()
+}
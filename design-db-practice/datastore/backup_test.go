@@ -0,0 +1,75 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupRestore(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 100, MergeThreshold: 100}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	if err := db.Backup(&archive); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key1", "after backup"); err != nil {
+		t.Fatal(err)
+	}
+
+	restoreDir := filepath.Join(t.TempDir(), "restored")
+	if err := Restore(bytes.NewReader(archive.Bytes()), restoreDir); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := Open(restoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+
+	if _, err := restored.Get("key0"); err != ErrNotFound {
+		t.Errorf("Get(key0) = %v, want ErrNotFound", err)
+	}
+	for i := 1; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if value, err := restored.Get(key); err != nil || value != fmt.Sprintf("value%d", i) {
+			t.Errorf("Get(%s) = %q, %v", key, value, err)
+		}
+	}
+
+	t.Run("non-empty directory", func(t *testing.T) {
+		if err := Restore(bytes.NewReader(archive.Bytes()), restoreDir); err == nil {
+			t.Error("Restore over an existing database succeeded")
+		}
+	})
+
+	t.Run("truncated archive", func(t *testing.T) {
+		dir := t.TempDir()
+		err := Restore(bytes.NewReader(archive.Bytes()[:archive.Len()/2]), dir)
+		if err == nil {
+			t.Fatal("Restore of a truncated archive succeeded")
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("failed restore left %d files behind", len(entries))
+		}
+	})
+}
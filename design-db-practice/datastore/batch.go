@@ -0,0 +1,86 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// WriteBatch collects puts and deletes that Db.Write applies atomically.
+// The zero value is an empty batch ready to use.
+type WriteBatch struct {
+	entries []entry
+}
+
+// Put adds setting key to value to the batch.
+func (b *WriteBatch) Put(key, value string) {
+	b.entries = append(b.entries, entry{key: key, value: value})
+}
+
+// Delete adds removing key to the batch. Unlike Db.Delete, deleting a
+// missing key is not an error.
+func (b *WriteBatch) Delete(key string) {
+	b.entries = append(b.entries, entry{key: key, flags: flagTombstone})
+}
+
+// Len returns the number of operations in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
+
+// Write applies every operation of the batch in order. The batch is stored
+// as a single record, so after a crash either all of it is replayed or none.
+func (db *Db) Write(b *WriteBatch) error {
+	if b.Len() == 0 {
+		return nil
+	}
+
+	batch := make([]entry, len(b.entries))
+	copy(batch, b.entries)
+	return db.submit(entryWithAck{batch: batch})
+}
+
+// expandRecord calls fn for the record at loc, or for each record packed
+// into it if it is a batch. Packed records are complete records themselves,
+// so their locations can be read like any other. Encrypted records are
+// decrypted with c before fn sees them.
+func expandRecord(c *recordCipher, e entry, loc recordLocation, fn func(e entry, loc recordLocation) error) error {
+	e, err := c.decrypt(e)
+	if err != nil {
+		return err
+	}
+	if !e.isBatch() {
+		loc.version, loc.expiresAt = e.version, e.expiresAt
+		return fn(e, loc)
+	}
+
+	valueOffset := loc.offset + int64(len(e.key)) + 12
+	data := []byte(e.value)
+	for pos := 0; pos < len(data); {
+		if len(data)-pos < 4 {
+			return fmt.Errorf("truncated record in batch at offset %d", pos)
+		}
+		size := int(binary.LittleEndian.Uint32(data[pos:]))
+		if size > len(data)-pos {
+			return fmt.Errorf("record in batch at offset %d exceeds the batch", pos)
+		}
+		var inner entry
+		if err := inner.Decode(data[pos : pos+size]); err != nil {
+			return fmt.Errorf("bad record in batch at offset %d: %w", pos, err)
+		}
+		if inner, err = c.decrypt(inner); err != nil {
+			return fmt.Errorf("bad record in batch at offset %d: %w", pos, err)
+		}
+		innerLoc := recordLocation{
+			segmentID: loc.segmentID,
+			offset:    valueOffset + int64(pos),
+			size:      size,
+			version:   inner.version,
+			expiresAt: inner.expiresAt,
+		}
+		if err := fn(inner, innerLoc); err != nil {
+			return err
+		}
+		pos += size
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 150}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	if err := db.Put("old", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	var b WriteBatch
+	b.Put("k1", "v1")
+	b.Put("k2", "v2")
+	b.Delete("old")
+	b.Delete("missing")
+	b.Put("k1", "v1.1")
+	if err := db.Write(&b); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	check := func(t *testing.T) {
+		t.Helper()
+		want := map[string]string{"k1": "v1.1", "k2": "v2"}
+		for key, value := range want {
+			if got, err := db.Get(key); err != nil || got != value {
+				t.Errorf("Get(%s) = %q, %v; want %q", key, got, err, value)
+			}
+		}
+		for _, key := range []string{"old", "missing"} {
+			if _, err := db.Get(key); err != ErrNotFound {
+				t.Errorf("Get(%s) = %v, want ErrNotFound", key, err)
+			}
+		}
+	}
+	check(t)
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenWithOptions(tmp, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		for i := 0; i < 5; i++ {
+			if err := db.Put(fmt.Sprintf("filler%d", i), "some filler value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.MergeSegments(); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+}
+
+func TestWriteBatchTornTail(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k1", "before"); err != nil {
+		t.Fatal(err)
+	}
+	var b WriteBatch
+	b.Put("k1", "after")
+	b.Put("k2", "after")
+	if err := db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cut the batch record after its first packed record: that one is
+	// complete on disk, but must not be replayed without the rest.
+	path := filepath.Join(tmp, fmt.Sprintf(segmentFileFormat, 0))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-30); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if db.Recovery() == nil {
+		t.Error("torn batch was not reported")
+	}
+	if value, err := db.Get("k1"); err != nil || value != "before" {
+		t.Errorf("Get(k1) = %q, %v; want the value before the batch", value, err)
+	}
+	if _, err := db.Get("k2"); err != ErrNotFound {
+		t.Errorf("Get(k2) = %v, want ErrNotFound", err)
+	}
+}
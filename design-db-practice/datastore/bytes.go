@@ -0,0 +1,61 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+// PutBytes is Put for a key and value held in byte slices. Both are
+// copied, so the caller may reuse them as soon as it returns.
+func (db *Db) PutBytes(key, value []byte) error {
+	return db.Put(string(key), string(value))
+}
+
+// PutBytesNoCopy is PutBytes without copying value. The Db may keep
+// referring to it after the write, for watchers, so the caller hands it
+// over and must not modify it afterwards.
+func (db *Db) PutBytesNoCopy(key, value []byte) error {
+	return db.Put(string(key), unsafe.String(unsafe.SliceData(value), len(value)))
+}
+
+// GetBytes is Get for a key held in a byte slice. The returned value
+// belongs to the caller.
+func (db *Db) GetBytes(key []byte) ([]byte, error) {
+	value, err := db.Get(string(key))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
+}
+
+// ViewValue calls fn with the value of key without copying it out of the
+// read buffer. The slice is only valid until fn returns and must not be
+// modified. Expired keys are reported as ErrNotFound, like by Get.
+//
+// The index lock is not held while fn runs, so fn may use the Db.
+func (db *Db) ViewValue(key []byte, fn func(value []byte) error) error {
+	// Lookups do not keep the key, so it need not be copied.
+	k := unsafe.String(unsafe.SliceData(key), len(key))
+	db.indexMutex.RLock()
+	loc, ok := db.index.get(k)
+	if !ok || loc.expired(time.Now()) {
+		db.indexMutex.RUnlock()
+		return ErrNotFound
+	}
+	if value, ok := db.cache.get(k); ok {
+		db.indexMutex.RUnlock()
+		return fn(unsafe.Slice(unsafe.StringData(value), len(value)))
+	}
+	s, ok := db.segments[loc.segmentID]
+	if !ok {
+		db.indexMutex.RUnlock()
+		return fmt.Errorf("segment %d is not open", loc.segmentID)
+	}
+	// The reference keeps the file readable even if a merge retires the
+	// segment meanwhile.
+	s.acquire()
+	db.indexMutex.RUnlock()
+	defer s.release()
+	return s.viewValue(loc, db.cipher, fn)
+}
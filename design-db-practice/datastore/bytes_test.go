@@ -0,0 +1,90 @@
+package datastore
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBytes(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{CacheSize: 1024, CompressionThreshold: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	key := []byte{0, 'k', 0xff}
+	stored := []byte{0, 1, 2, 0xfe, 0xff, 0}
+	buf := bytes.Clone(key)
+	value := bytes.Clone(stored)
+	if err := db.PutBytes(buf, value); err != nil {
+		t.Fatal(err)
+	}
+	// The caller may reuse its buffers right away.
+	buf[1], value[1] = 'x', 'x'
+
+	for i := 0; i < 2; i++ {
+		// The second round reads from the cache.
+		got, err := db.GetBytes(key)
+		if err != nil || !bytes.Equal(got, stored) {
+			t.Errorf("GetBytes = %v, %v, want %v", got, err, stored)
+		}
+		err = db.ViewValue(key, func(got []byte) error {
+			if !bytes.Equal(got, stored) {
+				t.Errorf("ViewValue got %v, want %v", got, stored)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("no copy", func(t *testing.T) {
+		large := []byte(strings.Repeat("large ", 50))
+		if err := db.PutBytesNoCopy([]byte("large"), large); err != nil {
+			t.Fatal(err)
+		}
+		err := db.ViewValue([]byte("large"), func(got []byte) error {
+			if !bytes.Equal(got, large) {
+				t.Errorf("ViewValue of a compressed value got %d bytes, want %d", len(got), len(large))
+			}
+			// The Db is usable while fn runs.
+			return db.Put("other", "value")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		if _, err := db.GetBytes([]byte("missing")); err != ErrNotFound {
+			t.Errorf("GetBytes of a missing key = %v, want ErrNotFound", err)
+		}
+		if err := db.ViewValue([]byte("missing"), nil); err != ErrNotFound {
+			t.Errorf("ViewValue of a missing key = %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func BenchmarkViewValue(b *testing.B) {
+	db, keys := benchmarkDb(b)
+	byteKeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		byteKeys[i] = []byte(key)
+	}
+	var n int
+	count := func(value []byte) error {
+		n += len(value)
+		return nil
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := db.ViewValue(byteKeys[i%len(keys)], count); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
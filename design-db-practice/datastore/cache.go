@@ -0,0 +1,118 @@
+package datastore
+
+import (
+	"container/list"
+	"sync"
+)
+
+// cacheEntryOverhead approximates the memory a cached value takes on top
+// of its key and value.
+const cacheEntryOverhead = 64
+
+// CacheStats describes the value cache of a Db.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	// Entries and Bytes are what the cache holds now; Bytes counts keys,
+	// values and bookkeeping.
+	Entries int
+	Bytes   int64
+}
+
+type cacheEntry struct {
+	key, value string
+}
+
+// valueCache is an LRU cache of decoded values bounded by their size. A
+// nil *valueCache caches nothing.
+//
+// Reads fill it under the read lock of the index and writes invalidate it
+// under the write lock, so a cached value is always the one the index
+// points to.
+type valueCache struct {
+	mu       sync.Mutex
+	capacity int64
+	order    *list.List
+	entries  map[string]*list.Element
+	stats    CacheStats
+}
+
+func newValueCache(capacity int64) *valueCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &valueCache{capacity: capacity, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func cacheEntrySize(key, value string) int64 {
+	return int64(len(key) + len(value) + cacheEntryOverhead)
+}
+
+func (c *valueCache) get(key string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.stats.Misses++
+		return "", false
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).value, true
+}
+
+func (c *valueCache) add(key, value string) {
+	if c == nil {
+		return
+	}
+	size := cacheEntrySize(key, value)
+	if size > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, value: value})
+	c.stats.Entries++
+	c.stats.Bytes += size
+	for c.stats.Bytes > c.capacity {
+		c.removeLocked(c.order.Back().Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+func (c *valueCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *valueCache) removeLocked(key string) {
+	el, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	e := c.order.Remove(el).(*cacheEntry)
+	delete(c.entries, key)
+	c.stats.Entries--
+	c.stats.Bytes -= cacheEntrySize(e.key, e.value)
+}
+
+// CacheStats returns the counters of the value cache. They are all zero
+// if Options.CacheSize is not set.
+func (db *Db) CacheStats() CacheStats {
+	c := db.cache
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
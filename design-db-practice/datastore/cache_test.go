@@ -0,0 +1,90 @@
+package datastore
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValueCache(t *testing.T) {
+	tmp := t.TempDir()
+	value := strings.Repeat("v", 100)
+	// Room for two values with their keys and overhead.
+	opts := Options{CacheSize: 2 * cacheEntrySize("k1", value)}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	for _, key := range []string{"k1", "k2", "k3"} {
+		if err := db.Put(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(key, want string) {
+		t.Helper()
+		if got, err := db.Get(key); err != nil || got != want {
+			t.Errorf("Get(%s) = %q, %v, want %q", key, got, err, want)
+		}
+	}
+
+	get("k1", value)
+	get("k1", value)
+	if stats := db.CacheStats(); stats.Hits != 1 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("stats after two reads = %+v", stats)
+	}
+
+	t.Run("writes invalidate", func(t *testing.T) {
+		if err := db.Put("k1", "new"); err != nil {
+			t.Fatal(err)
+		}
+		get("k1", "new")
+		if err := db.Delete("k1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("k1"); err != ErrNotFound {
+			t.Errorf("Get after Delete = %v, want ErrNotFound", err)
+		}
+		var batch WriteBatch
+		batch.Put("k1", "batched")
+		if err := db.Write(&batch); err != nil {
+			t.Fatal(err)
+		}
+		get("k1", "batched")
+	})
+
+	t.Run("eviction", func(t *testing.T) {
+		get("k2", value)
+		get("k3", value)
+		get("k2", value)
+		stats := db.CacheStats()
+		if stats.Evictions == 0 || stats.Bytes > opts.CacheSize {
+			t.Errorf("stats after filling the cache = %+v", stats)
+		}
+		// k2 was used last, so it must still be cached.
+		before := db.CacheStats().Hits
+		get("k2", value)
+		if db.CacheStats().Hits != before+1 {
+			t.Error("recently used value was evicted")
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		db, err := Open(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if err := db.Put("k", "v"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("k"); err != nil {
+			t.Fatal(err)
+		}
+		if stats := db.CacheStats(); stats != (CacheStats{}) {
+			t.Errorf("stats of a Db without cache = %+v", stats)
+		}
+	})
+}
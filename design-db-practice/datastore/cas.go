@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"errors"
+)
+
+// ErrConditionFailed is returned by conditional writes when the key is not
+// in the expected state.
+var ErrConditionFailed = errors.New("write condition failed")
+
+type conditionKind int
+
+const (
+	condVersion conditionKind = iota
+	condNotVersion
+	condExists
+	condMissing
+	condValue
+)
+
+// Condition is a precondition of a write, checked atomically with it.
+type Condition struct {
+	kind    conditionKind
+	version uint64
+	value   string
+}
+
+// IfVersion requires the key to exist with the given version.
+func IfVersion(version uint64) Condition {
+	return Condition{kind: condVersion, version: version}
+}
+
+// IfNotVersion requires the key to be missing or have another version.
+func IfNotVersion(version uint64) Condition {
+	return Condition{kind: condNotVersion, version: version}
+}
+
+// IfExists requires the key to exist.
+func IfExists() Condition {
+	return Condition{kind: condExists}
+}
+
+// IfMissing requires the key not to exist.
+func IfMissing() Condition {
+	return Condition{kind: condMissing}
+}
+
+// IfValue requires the key to exist with the given value.
+func IfValue(value string) Condition {
+	return Condition{kind: condValue, value: value}
+}
+
+// PutIf sets the key to value if cond holds and returns the new version of
+// the key. It returns ErrConditionFailed otherwise.
+func (db *Db) PutIf(key, value string, cond Condition) (uint64, error) {
+	var version uint64
+	err := db.submit(entryWithAck{
+		entry:   entry{key: key, value: value},
+		cond:    &cond,
+		version: &version,
+	})
+	return version, err
+}
+
+// CompareAndSwap sets the key to newValue only if it currently holds
+// expected. It reports whether the value was swapped.
+func (db *Db) CompareAndSwap(key, expected, newValue string) (bool, error) {
+	_, err := db.PutIf(key, newValue, IfValue(expected))
+	if errors.Is(err, ErrConditionFailed) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// checkCondition reports whether cond holds for a key at loc. The caller
+// must hold indexMutex.
+func (db *Db) checkCondition(cond Condition, loc recordLocation, exists bool) error {
+	var ok bool
+	switch cond.kind {
+	case condVersion:
+		ok = exists && loc.version == cond.version
+	case condNotVersion:
+		ok = !exists || loc.version != cond.version
+	case condExists:
+		ok = exists
+	case condMissing:
+		ok = !exists
+	case condValue:
+		if exists {
+			value, err := db.readValue(loc)
+			if err != nil {
+				return err
+			}
+			ok = value == cond.value
+		}
+	}
+	if !ok {
+		return ErrConditionFailed
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package datastore
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestVersions(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 60}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	checkVersion := func(t *testing.T, key string, want uint64) {
+		t.Helper()
+		_, version, err := db.GetWithVersion(key)
+		if err != nil {
+			t.Fatalf("GetWithVersion(%s): %v", key, err)
+		}
+		if version != want {
+			t.Errorf("version of %s = %d, want %d", key, version, want)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := db.Put("k", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkVersion(t, "k", 3)
+
+	var b WriteBatch
+	b.Put("k", "batch")
+	b.Put("k", "batch again")
+	b.Put("other", "v")
+	if err := db.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, "k", 5)
+	checkVersion(t, "other", 1)
+
+	if err := db.Delete("other"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("other", "recreated"); err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(t, "other", 1)
+
+	t.Run("reopen and merge", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenWithOptions(tmp, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkVersion(t, "k", 5)
+
+		if err := db.Put("filler", "v"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.MergeSegments(); err != nil {
+			t.Fatal(err)
+		}
+		checkVersion(t, "k", 5)
+		checkVersion(t, "other", 1)
+	})
+}
+
+func TestPutIf(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	version, err := db.PutIf("k", "v1", IfMissing())
+	if err != nil || version != 1 {
+		t.Fatalf("PutIf(IfMissing) on a new key = %d, %v", version, err)
+	}
+	if _, err := db.PutIf("k", "v", IfMissing()); !errors.Is(err, ErrConditionFailed) {
+		t.Errorf("PutIf(IfMissing) on an existing key: %v", err)
+	}
+	if _, err := db.PutIf("k", "v", IfVersion(7)); !errors.Is(err, ErrConditionFailed) {
+		t.Errorf("PutIf with a stale version: %v", err)
+	}
+	if _, err := db.PutIf("k", "v", IfNotVersion(1)); !errors.Is(err, ErrConditionFailed) {
+		t.Errorf("PutIf(IfNotVersion) with the current version: %v", err)
+	}
+	if _, err := db.PutIf("missing", "v", IfExists()); !errors.Is(err, ErrConditionFailed) {
+		t.Errorf("PutIf(IfExists) on a missing key: %v", err)
+	}
+	version, err = db.PutIf("k", "v2", IfVersion(1))
+	if err != nil || version != 2 {
+		t.Fatalf("PutIf with the current version = %d, %v", version, err)
+	}
+	if value, _ := db.Get("k"); value != "v2" {
+		t.Errorf("Get(k) = %q after a failed condition, want v2", value)
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	if swapped, err := db.CompareAndSwap("counter", "0", "1"); err != nil || swapped {
+		t.Errorf("CompareAndSwap on a missing key = %v, %v", swapped, err)
+	}
+	if err := db.Put("counter", "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, increments = 8, 20
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; {
+				current, err := db.Get("counter")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				n, _ := strconv.Atoi(current)
+				swapped, err := db.CompareAndSwap("counter", current, strconv.Itoa(n+1))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if swapped {
+					i++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if value, _ := db.Get("counter"); value != strconv.Itoa(workers*increments) {
+		t.Errorf("counter = %s, want %d", value, workers*increments)
+	}
+}
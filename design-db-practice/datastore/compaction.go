@@ -0,0 +1,127 @@
+package datastore
+
+import (
+	"sort"
+	"time"
+)
+
+// CompactionPolicy decides which sealed segments are merged. Select gets
+// the sealed segments oldest first and returns the IDs of those to merge.
+// Segments that are adjacent in that order are merged into one, so a
+// policy that wants a single result should select a contiguous range.
+type CompactionPolicy interface {
+	Select(sealed []SegmentStats, now time.Time) []int
+}
+
+// SegmentCountPolicy merges all sealed segments once there are more than
+// Threshold segment files, counting the current one.
+type SegmentCountPolicy struct {
+	Threshold int
+}
+
+func (p SegmentCountPolicy) Select(sealed []SegmentStats, _ time.Time) []int {
+	if len(sealed)+1 <= p.Threshold {
+		return nil
+	}
+	return segmentIDs(sealed)
+}
+
+// DeadRatioPolicy merges the sealed segments in which at least Ratio of the
+// bytes could be reclaimed, leaving the others alone.
+type DeadRatioPolicy struct {
+	Ratio float64
+}
+
+func (p DeadRatioPolicy) Select(sealed []SegmentStats, _ time.Time) []int {
+	var ids []int
+	for _, s := range sealed {
+		if s.Reclaimable > 0 && float64(s.Reclaimable) >= p.Ratio*float64(s.Size) {
+			ids = append(ids, s.ID)
+		}
+	}
+	return ids
+}
+
+// TimeWindowPolicy lets Policy select segments only between Start and End,
+// given as offsets from local midnight. A window with End before Start
+// spans midnight.
+type TimeWindowPolicy struct {
+	Start, End time.Duration
+	Policy     CompactionPolicy
+}
+
+func (p TimeWindowPolicy) Select(sealed []SegmentStats, now time.Time) []int {
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	at := now.Sub(midnight)
+	in := p.Start <= at && at < p.End
+	if p.End < p.Start {
+		in = at >= p.Start || at < p.End
+	}
+	if !in {
+		return nil
+	}
+	return p.Policy.Select(sealed, now)
+}
+
+func segmentIDs(segments []SegmentStats) []int {
+	ids := make([]int, len(segments))
+	for i, s := range segments {
+		ids[i] = s.ID
+	}
+	return ids
+}
+
+// compactionCheckInterval is how often the write loop asks the policy,
+// so that policies depending on the time get a chance without writes.
+const compactionCheckInterval = time.Minute
+
+// Compact merges the sealed segments the compaction policy selects. Each
+// run of adjacent selected segments is merged into one, and the others
+// are left as they are.
+func (db *Db) Compact() error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	db.mergeMutex.Lock()
+	defer db.mergeMutex.Unlock()
+
+	ids := db.sealedIDs()
+	if len(ids) == 0 {
+		return nil
+	}
+	sealed := make([]SegmentStats, len(ids))
+	db.indexMutex.RLock()
+	for i, id := range ids {
+		sealed[i] = db.space[id].stats(id)
+	}
+	db.indexMutex.RUnlock()
+
+	position := make(map[int]int, len(ids))
+	for i, id := range ids {
+		position[id] = i
+	}
+	var selected []int
+	for _, id := range db.opts.Compaction.Select(sealed, time.Now()) {
+		if i, ok := position[id]; ok {
+			selected = append(selected, i)
+			delete(position, id)
+		}
+	}
+	sort.Ints(selected)
+
+	for start := 0; start < len(selected); {
+		end := start + 1
+		for end < len(selected) && selected[end] == selected[end-1]+1 {
+			end++
+		}
+		run := make([]int, 0, end-start)
+		for _, i := range selected[start:end] {
+			run = append(run, ids[i])
+		}
+		if err := db.mergeRun(run, selected[start] == 0); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
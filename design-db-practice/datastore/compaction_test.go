@@ -0,0 +1,166 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// switchedPolicy selects nothing until it is switched on, so that merges
+// only happen when the test asks for them.
+type switchedPolicy struct {
+	on     atomic.Bool
+	policy CompactionPolicy
+}
+
+func (p *switchedPolicy) Select(sealed []SegmentStats, now time.Time) []int {
+	if !p.on.Load() {
+		return nil
+	}
+	return p.policy.Select(sealed, now)
+}
+
+func TestCompactionPolicies(t *testing.T) {
+	sealed := []SegmentStats{
+		{ID: 0, Size: 100, LiveBytes: 90, DeadBytes: 10, Reclaimable: 0},
+		{ID: 1, Size: 100, LiveBytes: 20, DeadBytes: 80, Reclaimable: 64},
+		{ID: 2, Size: 100, LiveBytes: 50, DeadBytes: 50, Reclaimable: 34},
+		{ID: 3, Size: 100, LiveBytes: 10, DeadBytes: 90, Reclaimable: 74},
+	}
+	at := func(hour, minute int) time.Time {
+		return time.Date(2024, 5, 1, hour, minute, 0, 0, time.Local)
+	}
+	night := TimeWindowPolicy{Start: 22 * time.Hour, End: 4 * time.Hour, Policy: SegmentCountPolicy{}}
+	tests := []struct {
+		name   string
+		policy CompactionPolicy
+		now    time.Time
+		want   []int
+	}{
+		{"count below threshold", SegmentCountPolicy{Threshold: 5}, at(12, 0), nil},
+		{"count above threshold", SegmentCountPolicy{Threshold: 4}, at(12, 0), []int{0, 1, 2, 3}},
+		{"dead ratio", DeadRatioPolicy{Ratio: 0.5}, at(12, 0), []int{1, 3}},
+		{"dead ratio of zero", DeadRatioPolicy{}, at(12, 0), []int{1, 2, 3}},
+		{"inside window", TimeWindowPolicy{Start: 9 * time.Hour, End: 17 * time.Hour, Policy: DeadRatioPolicy{Ratio: 0.5}}, at(12, 0), []int{1, 3}},
+		{"after window", TimeWindowPolicy{Start: 9 * time.Hour, End: 17 * time.Hour, Policy: DeadRatioPolicy{Ratio: 0.5}}, at(17, 0), nil},
+		{"window over midnight, evening", night, at(23, 30), []int{0, 1, 2, 3}},
+		{"window over midnight, morning", night, at(3, 59), []int{0, 1, 2, 3}},
+		{"window over midnight, day", night, at(12, 0), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Select(sealed, tt.now); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Select = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPartialCompaction(t *testing.T) {
+	tmp := t.TempDir()
+	policy := &switchedPolicy{policy: DeadRatioPolicy{Ratio: 0.5}}
+	opts := Options{SegmentSize: 200, Compaction: policy}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	// Keys that are never overwritten fill the oldest segments, the
+	// overwrites of hot make the later ones mostly garbage.
+	if err := db.Put("short", "value"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		if err := db.Put(fmt.Sprintf("cold-%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := db.Put("hot", fmt.Sprintf("value-%02d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(6)
+	// Their older records stay in segments the merge keeps.
+	if err := db.Delete("cold-0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("short", "value", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	put(30)
+	time.Sleep(5 * time.Millisecond)
+
+	check := func(t *testing.T) {
+		t.Helper()
+		for i := 1; i < 8; i++ {
+			if got, err := db.Get(fmt.Sprintf("cold-%d", i)); err != nil || got != "value" {
+				t.Errorf("Get(cold-%d) = %q, %v", i, got, err)
+			}
+		}
+		for _, key := range []string{"cold-0", "short"} {
+			if got, err := db.Get(key); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get(%s) = %q, %v, want ErrNotFound", key, got, err)
+			}
+		}
+		if got, err := db.Get("hot"); err != nil || got != "value-29" {
+			t.Errorf("Get(hot) = %q, %v", got, err)
+		}
+		checkSpace(t, db)
+	}
+	check(t)
+
+	before := db.Stats()
+	kept := make(map[int][]byte)
+	selected := 0
+	for _, s := range before.Segments[:len(before.Segments)-1] {
+		if float64(s.Reclaimable) >= 0.5*float64(s.Size) {
+			selected++
+			continue
+		}
+		if kept[s.ID], err = os.ReadFile(db.segmentPath(s.ID)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if selected < 2 || len(kept) < 2 {
+		t.Fatalf("%d segments to merge and %d to keep in %+v", selected, len(kept), before.Segments)
+	}
+
+	policy.on.Store(true)
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check(t)
+	after := db.Stats()
+	if after.Merges == 0 || after.DeadBytes >= before.DeadBytes {
+		t.Errorf("Compact left %d dead bytes of %d in %d merges", after.DeadBytes, before.DeadBytes, after.Merges)
+	}
+	for id, data := range kept {
+		if got, _ := os.ReadFile(db.segmentPath(id)); !bytes.Equal(got, data) {
+			t.Errorf("segment %d was rewritten", id)
+		}
+	}
+	// Kept tombstones are not counted as reclaimable, so the merged
+	// segments are not merged over and over.
+	if ids := policy.Select(after.Segments[:len(after.Segments)-1], time.Now()); len(ids) > 0 {
+		t.Errorf("segments %v selected again in %+v", ids, after.Segments)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenWithOptions(tmp, opts); err != nil {
+		t.Fatal(err)
+	}
+	check(t)
+}
@@ -0,0 +1,66 @@
+package datastore
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// compressor deflates values on the write loop, reusing one flate writer.
+type compressor struct {
+	w   *flate.Writer
+	buf bytes.Buffer
+}
+
+// compress stores the value of e deflated if that makes it smaller.
+// Batches are left alone; their records are compressed one by one.
+func (c *compressor) compress(e entry) entry {
+	if e.isTombstone() || e.isBatch() {
+		return e
+	}
+	c.buf.Reset()
+	if c.w == nil {
+		c.w, _ = flate.NewWriter(&c.buf, flate.DefaultCompression)
+	} else {
+		c.w.Reset(&c.buf)
+	}
+	if _, err := io.WriteString(c.w, e.value); err != nil {
+		return e
+	}
+	if err := c.w.Close(); err != nil || c.buf.Len() >= len(e.value) {
+		return e
+	}
+	e.value = c.buf.String()
+	e.flags |= flagCompressed
+	return e
+}
+
+var flateReaders sync.Pool
+
+// inflate returns the original value of a compressed one.
+func inflate(compressed []byte) ([]byte, error) {
+	r, ok := flateReaders.Get().(io.ReadCloser)
+	if ok {
+		r.(flate.Resetter).Reset(bytes.NewReader(compressed), nil)
+	} else {
+		r = flate.NewReader(bytes.NewReader(compressed))
+	}
+	defer flateReaders.Put(r)
+
+	value := bytes.NewBuffer(make([]byte, 0, 2*len(compressed)))
+	if _, err := io.Copy(value, r); err != nil {
+		return nil, fmt.Errorf("cannot decompress value: %w", err)
+	}
+	return value.Bytes(), nil
+}
+
+// plainValue returns the value of e as it was put.
+func (e *entry) plainValue() (string, error) {
+	if e.flags&flagCompressed == 0 {
+		return e.value, nil
+	}
+	value, err := inflate([]byte(e.value))
+	return string(value), err
+}
@@ -0,0 +1,104 @@
+package datastore
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	tmp := t.TempDir()
+	// An uncompressed record written before compression was enabled.
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := strings.Repeat("plain ", 100)
+	if err := db.Put("old", plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{CompressionThreshold: 64}
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	large := strings.Repeat("compressible ", 100)
+	pairs := map[string]string{
+		"old":   plain,
+		"large": large,
+		"small": "tiny",
+		// Random-looking data does not shrink and is stored as is.
+		"noise": "q8#Zk!2v@Lp9&Xw$Rm4^Tn7*Bh3(Jd6)Yf1_Gc5+Vs0=Ue8~Oa2|Ii4<Ky7>Nb9?",
+	}
+	for _, key := range []string{"large", "small", "noise"} {
+		if err := db.Put(key, pairs[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var batch WriteBatch
+	batch.Put("batched", large)
+	if err := db.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+	pairs["batched"] = large
+
+	check := func(t *testing.T) {
+		t.Helper()
+		for key, want := range pairs {
+			if got, err := db.Get(key); err != nil || got != want {
+				t.Errorf("Get(%s) = %d bytes, %v, want %d bytes", key, len(got), err, len(want))
+			}
+		}
+	}
+	check(t)
+
+	info, err := os.Stat(db.segmentPath(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > int64(len(plain)+2*len(large)) {
+		t.Errorf("segment has %d bytes, values do not seem compressed", info.Size())
+	}
+
+	t.Run("watch", func(t *testing.T) {
+		w, err := db.Watch("", db.LastSeq())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		if err := db.Put("watched", large); err != nil {
+			t.Fatal(err)
+		}
+		pairs["watched"] = large
+		if c := nextChange(t, w); c.Value != large {
+			t.Errorf("watched value has %d bytes, want %d", len(c.Value), len(large))
+		}
+	})
+
+	t.Run("merge and reopen", func(t *testing.T) {
+		if err := db.Backup(io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.MergeSegments(); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenWithOptions(tmp, Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+}
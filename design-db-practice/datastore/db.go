@@ -2,57 +2,145 @@ package datastore
 
 import (
 	"bufio"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const segmentFileFormat = "segment-%06d.db"
 
-var maxSegmentSize int64 = 10 * 1024 * 1024
-
 var ErrNotFound = fmt.Errorf("record does not exist")
 
+var errChecksumMismatch = errors.New("data corrupted: checksum mismatch")
+
+var errClosed = errors.New("database is closed")
+
 type recordLocation struct {
 	segmentID int
 	offset    int64
+	size      int
+	// version counts the puts of the key since it was last created.
+	version uint64
+	// expiresAt is the expiry time in Unix nanoseconds, 0 if none.
+	expiresAt int64
 }
 
-type hashIndex map[string]recordLocation
+func (loc recordLocation) expired(now time.Time) bool {
+	return loc.expiresAt != 0 && loc.expiresAt <= now.UnixNano()
+}
 
 type Db struct {
 	dir           string
 	currentFile   *os.File
 	currentOffset int64
 	currentID     int
-	index         hashIndex
+	currentHints  []hintEntry
 
+	// view holds the index and the open segments; both are guarded by
+	// indexMutex.
+	view
 	indexMutex sync.RWMutex
-	putChan    chan entryWithAck
-	wg         sync.WaitGroup
-	closeChan  chan struct{}
-	closeOnce  sync.Once
+	// space tracks the live bytes of the segments for Stats, guarded by
+	// indexMutex.
+	space     map[int]segmentSpace
+	putChan   chan entryWithAck
+	wg        sync.WaitGroup
+	closeChan chan struct{}
+	closeOnce sync.Once
+	// sendMutex is held for reading while a write is handed to putChan,
+	// so that Close knows when none is on its way anymore.
+	sendMutex sync.RWMutex
+
+	mergeMutex sync.Mutex
+	merging    atomic.Bool
+	// staleCurrent is set while the current segment holds records from
+	// before Open, which may be encrypted with a previous key.
+	staleCurrent atomic.Bool
+	// merges counts the merges done, which took mergeNanos together and
+	// lastMergeNanos the latest.
+	merges         atomic.Int64
+	mergeNanos     atomic.Int64
+	lastMergeNanos atomic.Int64
+
+	recovery *RecoveryReport
+	// skipped lists the corrupt records left out under CorruptionSkip.
+	skippedMutex sync.Mutex
+	skipped      []*CorruptRecordError
+
+	// logSignal is closed and replaced after every write, under
+	// indexMutex, to wake up log readers and watchers.
+	logSignal chan struct{}
+	// compressor is only used by the write loop.
+	compressor compressor
+
+	// lastSeq is the sequence number of the latest write and changes
+	// holds the recent ones for Watch; both are guarded by indexMutex.
+	lastSeq uint64
+	changes changeHistory
+
+	opts      Options
+	dirty     bool
+	syncCount atomic.Int64
+	// lastSync is the time of the latest fsync in Unix nanoseconds.
+	lastSync atomic.Int64
+	// lock holds the lock of the directory until Close.
+	lock *os.File
 }
 
+// Open opens the database in dir with DefaultOptions.
 func Open(dir string) (*Db, error) {
+	return OpenWithOptions(dir, DefaultOptions())
+}
+
+// OpenWithOptions opens the database in dir configured by opts.
+func OpenWithOptions(dir string, opts Options) (*Db, error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	cipher, err := newRecordCipher(opts.EncryptionKey, opts.PreviousKeys)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := lockDir(dir, !opts.ReadOnly, opts.FileMode)
+	if err != nil {
+		return nil, err
+	}
 	db := &Db{
-		dir:       dir,
-		index:     make(hashIndex),
-		putChan:   make(chan entryWithAck, 100),
+		dir: dir,
+		view: view{
+			index:    newIndex(opts),
+			segments: make(map[int]*segment),
+			cache:    newValueCache(opts.CacheSize),
+			cipher:   cipher,
+		},
+		space:     make(map[int]segmentSpace),
+		putChan:   make(chan entryWithAck, opts.WriteQueueSize),
 		closeChan: make(chan struct{}),
+		logSignal: make(chan struct{}),
+		opts:      opts,
+		lock:      lock,
 	}
 
 	if err := db.loadSegments(); err != nil {
+		lock.Close()
 		return nil, err
 	}
-	db.wg.Add(1)
-	go db.writeLoop()
+	db.changes = changeHistory{limit: opts.WatchHistory, floor: db.lastSeq}
+	if !opts.ReadOnly {
+		db.wg.Add(1)
+		go db.writeLoop()
+	}
 
 	return db, nil
 }
@@ -60,64 +148,194 @@ func Open(dir string) (*Db, error) {
 func (db *Db) writeLoop() {
 	defer db.wg.Done()
 
+	var tick <-chan time.Time
+	if db.opts.Sync.Mode == SyncInterval {
+		ticker := time.NewTicker(db.opts.Sync.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	compaction := time.NewTicker(compactionCheckInterval)
+	defer compaction.Stop()
+
 	for {
 		select {
 		case eAck, ok := <-db.putChan:
 			if !ok {
 				return
 			}
-			err := db.writeEntry(eAck.entry)
-			eAck.ack <- err
+			db.commitGroup(db.drainPending([]entryWithAck{eAck}))
+		case <-tick:
+			_ = db.syncCurrent()
+		case <-compaction.C:
+			db.startMerge()
 		case <-db.closeChan:
+			// Writes queued before Close are turned down, until Close
+			// closes putChan once no more are on their way.
+			for eAck := range db.putChan {
+				eAck.ack <- errClosed
+			}
 			return
 		}
 	}
 }
 
-func (db *Db) writeEntry(e entry) error {
-	data := e.Encode()
-
-	if db.currentOffset+int64(len(data)) > maxSegmentSize {
-		if err := db.currentFile.Close(); err != nil {
+func (db *Db) writeEntry(req entryWithAck) error {
+	e := req.entry
+	if !req.replicated {
+		var err error
+		if e, err = db.prepareEntry(req); err != nil {
 			return err
 		}
-		db.currentID++
-		if err := db.openCurrentSegment(); err != nil {
+	}
+	var data []byte
+	size := entryFixedSize + int64(len(e.key)) + req.streamSize + int64(len(e.encodeMeta()))
+	if req.stream == nil {
+		data = db.cipher.encode(e)
+		size = int64(len(data))
+	}
+
+	if db.currentOffset > segmentHeaderSize && db.currentOffset+size > db.opts.SegmentSize {
+		if err := db.sealCurrent(); err != nil {
 			return err
 		}
+	}
 
-		files, _ := os.ReadDir(db.dir)
-		count := 0
-		for _, f := range files {
-			if strings.HasPrefix(f.Name(), "segment-") && strings.HasSuffix(f.Name(), ".db") {
-				count++
-			}
+	var n int
+	var err error
+	if req.stream != nil {
+		var written int64
+		written, err = e.encodeStream(db.currentFile, req.stream, req.streamSize)
+		if err != nil {
+			// Nothing refers to the partial record yet, so it is cut off
+			// rather than left for Open to repair.
+			_ = db.currentFile.Truncate(db.currentOffset)
+			return err
 		}
-		if count > 3 {
-			_ = db.MergeSegments()
+		n = int(written)
+		e.detached = true
+	} else if n, err = db.currentFile.Write(data); err != nil {
+		return err
+	}
+	db.dirty = true
+
+	loc := recordLocation{segmentID: db.currentID, offset: db.currentOffset, size: n}
+	db.indexMutex.Lock()
+	db.addSize(db.currentID, int64(n))
+	err = expandRecord(db.cipher, e, loc, func(e entry, loc recordLocation) error {
+		he := newHintEntry(e, loc)
+		db.applyHint(loc.segmentID, he)
+		db.currentHints = append(db.currentHints, he)
+		db.changes.add(e)
+		db.cache.remove(e.key)
+		return nil
+	})
+	db.currentOffset += int64(n)
+	db.notifyLog()
+	db.indexMutex.Unlock()
+
+	if req.version != nil {
+		*req.version = e.version
+	}
+	return err
+}
+
+// sealCurrent closes the current segment and starts a new one. It runs on
+// the write loop.
+func (db *Db) sealCurrent() error {
+	if db.opts.Sync.Mode != SyncNever {
+		if err := db.syncCurrent(); err != nil {
+			return err
 		}
 	}
+	if err := db.currentFile.Close(); err != nil {
+		return err
+	}
+	// The hint only speeds up the next Open, which falls back to
+	// scanning the segment if it is missing.
+	_ = writeHintFile(db.hintPath(db.currentID), db.opts.FileMode, db.cipher, db.currentOffset, db.currentHints)
+	db.currentHints = nil
+	db.staleCurrent.Store(false)
 
-	n, err := db.currentFile.Write(data)
+	// Log readers look at the current segment and offset under the lock.
+	db.indexMutex.Lock()
+	db.currentID++
+	err := db.openCurrentSegment()
+	db.indexMutex.Unlock()
 	if err != nil {
 		return err
 	}
+	if err := db.addSegment(db.currentID); err != nil {
+		return err
+	}
+	db.startMerge()
+	return nil
+}
 
-	db.indexMutex.Lock()
-	db.index[e.key] = recordLocation{
-		segmentID: db.currentID,
-		offset:    db.currentOffset,
+// prepareEntry checks the condition of a write and assigns versions to the
+// records it puts and sequence numbers to all of them. It runs on the write
+// loop, so the index cannot change until the record is written.
+func (db *Db) prepareEntry(req entryWithAck) (entry, error) {
+	db.indexMutex.RLock()
+	defer db.indexMutex.RUnlock()
+
+	now := time.Now()
+	if req.batch != nil {
+		versions := make(map[string]uint64)
+		var value strings.Builder
+		for i, e := range req.batch {
+			e.seq = db.lastSeq + uint64(i) + 1
+			version, ok := versions[e.key]
+			if loc, _ := db.index.get(e.key); !ok && !loc.expired(now) {
+				version = loc.version
+			}
+			if e.isTombstone() {
+				version = 0
+			} else {
+				version++
+				e.version = version
+				e = db.maybeCompress(e)
+			}
+			versions[e.key] = version
+			value.Write(db.cipher.encode(e))
+		}
+		return entry{value: value.String(), flags: flagBatch}, nil
 	}
-	db.indexMutex.Unlock()
 
-	db.currentOffset += int64(n)
-	return nil
+	e := req.entry
+	loc, exists := db.index.get(e.key)
+	if exists && loc.expired(now) {
+		loc, exists = recordLocation{}, false
+	}
+	if req.cond != nil {
+		if err := db.checkCondition(*req.cond, loc, exists); err != nil {
+			return entry{}, err
+		}
+	}
+	if e.isTombstone() {
+		if !exists {
+			return entry{}, ErrNotFound
+		}
+		e.seq = db.lastSeq + 1
+		return e, nil
+	}
+	e.version = loc.version + 1
+	e.seq = db.lastSeq + 1
+	return db.maybeCompress(e), nil
 }
 
-func (db *Db) loadSegments() error {
+// maybeCompress compresses the value of e if it is large enough.
+func (db *Db) maybeCompress(e entry) entry {
+	if db.opts.CompressionThreshold == 0 || len(e.value) < db.opts.CompressionThreshold {
+		return e
+	}
+	return db.compressor.compress(e)
+}
+
+// segmentIDs lists the IDs of the segment files in ascending order.
+func (db *Db) segmentIDs() ([]int, error) {
 	entries, err := os.ReadDir(db.dir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	var segments []int
@@ -132,45 +350,305 @@ func (db *Db) loadSegments() error {
 		}
 	}
 	sort.Ints(segments)
+	return segments, nil
+}
+
+func (db *Db) loadSegments() error {
+	segments, err := db.segmentIDs()
+	if err != nil {
+		return err
+	}
+	if db.opts.ReadOnly {
+		return db.loadReadOnly(segments)
+	}
+	// Segments retired by a merge while a snapshot used them hold no
+	// records the merged segment lacks.
+	retired, _ := filepath.Glob(filepath.Join(db.dir, "retired-*.db"))
+	// Values staged by PutStream were never acknowledged.
+	staged, _ := filepath.Glob(filepath.Join(db.dir, streamFilePattern))
+	for _, path := range append(retired, staged...) {
+		os.Remove(path)
+	}
+
+	upgraded := make(map[int]bool)
+	for _, id := range segments {
+		moved, err := db.upgradeSegment(id)
+		if err != nil {
+			return err
+		}
+		upgraded[id] = moved
+	}
+
+	for i, id := range segments {
+		db.currentID = id
+		// The newest segment is always scanned: it becomes the current one
+		// and its records are needed for the hint written when it is sealed.
+		if i < len(segments)-1 && db.loadHint(id) == nil {
+			continue
+		}
+		last := i == len(segments)-1
+		hints, err := db.loadSegment(id, last)
+		var corrupt *CorruptRecordError
+		if last && errors.As(err, &corrupt) {
+			if torn, tornErr := db.tornTail(corrupt); tornErr != nil {
+				err = tornErr
+			} else if torn {
+				err = db.repairTail(corrupt)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		db.currentHints = hints
+	}
+	if len(segments) > 0 && upgraded[db.currentID] {
+		// Log positions taken before the upgrade do not match the records
+		// of the segment anymore, so it is sealed and log readers start
+		// over from the next one.
+		if info, err := os.Stat(db.segmentPath(db.currentID)); err == nil {
+			_ = writeHintFile(db.hintPath(db.currentID), db.opts.FileMode, db.cipher, info.Size(), db.currentHints)
+		}
+		db.currentHints = nil
+		db.currentID++
+		segments = append(segments, db.currentID)
+	}
 
+	if err := db.openCurrentSegment(); err != nil {
+		return err
+	}
+	db.staleCurrent.Store(db.cipher != nil && db.currentOffset > segmentHeaderSize)
+	if len(segments) == 0 {
+		segments = append(segments, db.currentID)
+	}
 	for _, id := range segments {
-		if err := db.loadSegment(id); err != nil {
+		if err := db.addSegment(id); err != nil {
 			return err
 		}
+	}
+	return nil
+}
+
+// loadReadOnly is loadSegments for a read-only Db: nothing is written, a
+// broken end of the newest segment is only left out of the index, and
+// the newest segment is not opened for writing.
+func (db *Db) loadReadOnly(segments []int) error {
+	for i, id := range segments {
 		db.currentID = id
+		last := i == len(segments)-1
+		// Upgrading rewrites the segment, so it is left to a writable Open.
+		if !last {
+			if err := db.checkSegmentHeader(id); err != nil {
+				return err
+			}
+			if db.loadHint(id) == nil {
+				continue
+			}
+		}
+		_, err := db.loadSegment(id, last)
+		var corrupt *CorruptRecordError
+		if last && errors.As(err, &corrupt) {
+			torn, tornErr := db.tornTail(corrupt)
+			if tornErr != nil {
+				return tornErr
+			}
+			if !torn {
+				return err
+			}
+			info, statErr := os.Stat(db.segmentPath(id))
+			if statErr != nil {
+				return statErr
+			}
+			db.recovery = &RecoveryReport{
+				SegmentID:    id,
+				Offset:       corrupt.Offset,
+				DroppedBytes: info.Size() - corrupt.Offset,
+				Cause:        corrupt.Err,
+			}
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if db.recovery != nil {
+		db.currentOffset = db.recovery.Offset
+	} else if len(segments) > 0 {
+		info, err := os.Stat(db.segmentPath(db.currentID))
+		if err != nil {
+			return err
+		}
+		db.currentOffset = info.Size()
+	}
+	for _, id := range segments {
+		if err := db.addSegment(id); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return db.openCurrentSegment()
+// addSegment opens a read handle of a segment and makes it available to
+// readers. Log readers may read it unless its header marks it rewritten.
+func (db *Db) addSegment(id int) error {
+	s, err := openSegment(id, db.segmentPath(id))
+	if err != nil {
+		return err
+	}
+	info, err := s.file.Stat()
+	if err != nil {
+		s.release()
+		return err
+	}
+	// A segment cut short before the end of its header has no records.
+	header, err := readSegmentHeader(id, io.NewSectionReader(s.file, 0, segmentHeaderSize))
+	s.logged = err == nil && header.flags&segmentRewritten == 0
+	db.indexMutex.Lock()
+	db.segments[id] = s
+	space := db.space[id]
+	space.size = info.Size()
+	space.pinned = min(space.size, segmentHeaderSize)
+	db.space[id] = space
+	db.indexMutex.Unlock()
+	return nil
 }
 
-func (db *Db) loadSegment(id int) error {
-	filePath := filepath.Join(db.dir, fmt.Sprintf(segmentFileFormat, id))
-	f, err := os.Open(filePath)
+// loadHint fills the index from the hint file of a segment. It leaves the
+// index untouched if the hint cannot be used.
+func (db *Db) loadHint(id int) error {
+	info, err := os.Stat(db.segmentPath(id))
 	if err != nil {
 		return err
 	}
+	hints, err := readHintFile(db.hintPath(id), db.cipher, info.Size())
+	if err != nil {
+		return err
+	}
+	for _, he := range hints {
+		db.applyHint(id, he)
+	}
+	return nil
+}
+
+// loadSegment adds the records of a segment to the index. On error the
+// hints of the records loaded so far are returned along with it. tail is
+// set for the newest segment, whose broken end is left to repairTail.
+func (db *Db) loadSegment(id int, tail bool) ([]hintEntry, error) {
+	var hints []hintEntry
+	_, err := db.scanSegment(id, tail, func(e entry, loc recordLocation) error {
+		he := newHintEntry(e, loc)
+		db.applyHint(id, he)
+		hints = append(hints, he)
+		return nil
+	})
+	if err != nil {
+		return hints, fmt.Errorf("loadSegment error: %w", err)
+	}
+	return hints, nil
+}
+
+// scanSegment calls fn for every record of the segment in file order,
+// with batches expanded into the records they contain, and returns how
+// many corrupt records it skipped.
+//
+// Records that cannot be decoded or fail their checksum are reported as
+// *CorruptRecordError, unless Options.OnCorruption says to skip them.
+// Skipping needs a record size that fits the segment; if the size is
+// broken, the rest of the segment is skipped, or reported if tail is set
+// and the caller repairs it.
+func (db *Db) scanSegment(id int, tail bool, fn func(e entry, loc recordLocation) error) (int, error) {
+	f, err := os.Open(db.segmentPath(id))
+	if err != nil {
+		return 0, err
+	}
 	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
 
 	reader := bufio.NewReader(f)
-	var offset int64
-	for {
+	if _, err := readSegmentHeader(id, reader); err != nil {
+		return 0, err
+	}
+	skip := db.opts.OnCorruption == CorruptionSkip
+	skipped := 0
+	for offset := int64(segmentHeaderSize); offset < info.Size(); {
+		left := info.Size() - offset
+		var size int64
+		if left >= 4 {
+			sizeBuf, _ := reader.Peek(4)
+			size = int64(binary.LittleEndian.Uint32(sizeBuf))
+		}
+		if size < entryFixedSize || size > left {
+			corrupt := &CorruptRecordError{SegmentID: id, Offset: offset, Err: fmt.Errorf("record size %d does not fit the segment", size)}
+			if !skip || tail {
+				return skipped, corrupt
+			}
+			db.skipCorrupt(corrupt)
+			return skipped + 1, nil
+		}
+
 		var e entry
 		n, err := e.DecodeFromReader(reader)
-		if errors.Is(err, io.EOF) {
-			break
+		if err == nil && e.detached && (e.isBatch() || e.flags&flagEncrypted != 0) {
+			// Their value is needed to expand them.
+			record := make([]byte, size)
+			if _, err = f.ReadAt(record, offset); err == nil {
+				err = e.Decode(record)
+			}
 		}
 		if err != nil {
-			return fmt.Errorf("loadSegment error: %w", err)
+			corrupt := &CorruptRecordError{SegmentID: id, Offset: offset, Err: err}
+			if !skip || int64(n) != size {
+				return skipped, corrupt
+			}
+			db.skipCorrupt(corrupt)
+			skipped++
+			offset += size
+			continue
+		}
+		if err := expandRecord(db.cipher, e, recordLocation{segmentID: id, offset: offset, size: n}, fn); err != nil {
+			return skipped, err
 		}
-		db.index[e.key] = recordLocation{segmentID: id, offset: offset}
 		offset += int64(n)
 	}
-	return nil
+	return skipped, nil
+}
+
+func (db *Db) applyHint(id int, he hintEntry) {
+	db.lastSeq = max(db.lastSeq, he.seq)
+	if he.flags&flagSeqMark != 0 {
+		return
+	}
+	loc := recordLocation{
+		segmentID: id,
+		offset:    he.offset,
+		size:      he.size,
+		version:   he.version,
+		expiresAt: he.expiresAt,
+	}
+	if he.flags&flagTombstone != 0 || loc.expired(time.Now()) {
+		db.removeLocation(he.key)
+		return
+	}
+	db.setLocation(he.key, loc)
+}
+
+func (db *Db) segmentPath(id int) string {
+	return filepath.Join(db.dir, fmt.Sprintf(segmentFileFormat, id))
+}
+
+func (db *Db) hintPath(id int) string {
+	return filepath.Join(db.dir, fmt.Sprintf(hintFileFormat, id))
+}
+
+func (db *Db) retiredPath(id int) string {
+	return filepath.Join(db.dir, fmt.Sprintf(retiredFileFormat, id))
 }
 
 func (db *Db) openCurrentSegment() error {
-	path := filepath.Join(db.dir, fmt.Sprintf(segmentFileFormat, db.currentID))
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	path := db.segmentPath(db.currentID)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, db.opts.FileMode)
 	if err != nil {
 		return err
 	}
@@ -181,72 +659,124 @@ func (db *Db) openCurrentSegment() error {
 		return err
 	}
 	db.currentOffset = info.Size()
+	if db.currentOffset == 0 {
+		n, err := f.Write(newSegmentHeader().encode())
+		if err != nil {
+			return err
+		}
+		db.currentOffset = int64(n)
+	}
 	return nil
 }
 
 func (db *Db) Close() error {
 	var err error
 	db.closeOnce.Do(func() {
+		close(db.closeChan)
+		db.sendMutex.Lock()
 		close(db.putChan)
+		db.sendMutex.Unlock()
 		db.wg.Wait()
 		if db.currentFile != nil {
-			err = db.currentFile.Close()
+			if db.opts.Sync.Mode != SyncNever {
+				err = db.syncCurrent()
+			}
+			if closeErr := db.currentFile.Close(); err == nil {
+				err = closeErr
+			}
+		}
+
+		db.indexMutex.Lock()
+		for _, s := range db.segments {
+			s.release()
 		}
+		db.segments = nil
+		db.indexMutex.Unlock()
+		db.lock.Close()
 	})
 	return err
 }
 
 type entryWithAck struct {
 	entry entry
+	// batch holds the records of a Db.Write; entry is unused then.
+	batch []entry
+	cond  *Condition
 	ack   chan error
+	// version, if set, receives the version assigned to entry before the
+	// write is acknowledged.
+	version *uint64
+	// seal asks for the current segment to be sealed instead of a write.
+	seal bool
+	// replicated marks an entry copied from another Db by Apply, which
+	// already carries its version.
+	replicated bool
+	// stream holds the value of entry, streamSize bytes staged by
+	// PutStream, if it is not in memory.
+	stream     *os.File
+	streamSize int64
 }
 
-func (db *Db) Put(key, value string) error {
-	ack := make(chan error)
-	e := entryWithAck{
-		entry: entry{key: key, value: value},
-		ack:   ack,
+// submit hands a write to the write loop and waits for its result.
+func (db *Db) submit(req entryWithAck) error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	req.ack = make(chan error)
+	db.sendMutex.RLock()
+	select {
+	case <-db.closeChan:
+		db.sendMutex.RUnlock()
+		return errClosed
+	default:
 	}
-
 	select {
-	case db.putChan <- e:
-		return <-ack
+	case db.putChan <- req:
+		db.sendMutex.RUnlock()
+		return <-req.ack
 	case <-db.closeChan:
-		return fmt.Errorf("database is closed")
+		db.sendMutex.RUnlock()
+		return errClosed
 	}
 }
 
-func (db *Db) Get(key string) (string, error) {
-	db.indexMutex.RLock()
-	loc, ok := db.index[key]
-	db.indexMutex.RUnlock()
-	if !ok {
-		return "", ErrNotFound
-	}
+func (db *Db) Put(key, value string) error {
+	return db.submit(entryWithAck{entry: entry{key: key, value: value}})
+}
 
-	filePath := filepath.Join(db.dir, fmt.Sprintf(segmentFileFormat, loc.segmentID))
-	f, err := os.Open(filePath)
-	if err != nil {
-		return "", err
-	}
-	defer f.Close()
+// Delete removes the key by appending a tombstone record to the current
+// segment. It returns ErrNotFound if the key does not exist.
+func (db *Db) Delete(key string) error {
+	return db.submit(entryWithAck{entry: entry{key: key, flags: flagTombstone}})
+}
 
-	_, err = f.Seek(loc.offset, io.SeekStart)
-	if err != nil {
-		return "", err
-	}
-	var e entry
-	_, err = e.DecodeFromReader(bufio.NewReader(f))
-	if err != nil {
-		return "", err
-	}
+func (db *Db) Get(key string) (string, error) {
+	item, err := db.GetItem(key)
+	return item.Value, err
+}
 
-	h := e.EncodeHash()
-	if h != e.hash {
-		return "", fmt.Errorf("data corrupted: hash mismatch")
-	}
+// GetWithVersion returns the value of the key along with its version.
+func (db *Db) GetWithVersion(key string) (string, uint64, error) {
+	item, err := db.GetItem(key)
+	return item.Value, item.Version, err
+}
+
+// Item is a value together with the metadata of its key.
+type Item struct {
+	Value   string
+	Version uint64
+	// ExpiresAt is the zero time for keys without a TTL.
+	ExpiresAt time.Time
+}
 
-	return e.value, nil
+// GetItem returns the value of the key with its metadata. Expired keys are
+// reported as ErrNotFound.
+func (db *Db) GetItem(key string) (Item, error) {
+	// The lock is held for the whole read so that a merge cannot replace
+	// the segment between the index lookup and the read.
+	db.indexMutex.RLock()
+	defer db.indexMutex.RUnlock()
+	return db.getItem(key)
 }
 
 func (db *Db) Size() (int64, error) {
@@ -258,6 +788,10 @@ func (db *Db) Size() (int64, error) {
 	for _, entry := range entries {
 		if strings.HasPrefix(entry.Name(), "segment-") {
 			info, err := os.Stat(filepath.Join(db.dir, entry.Name()))
+			if errors.Is(err, fs.ErrNotExist) {
+				// Removed by a merge running in the background.
+				continue
+			}
 			if err != nil {
 				return 0, err
 			}
@@ -266,104 +800,3 @@ func (db *Db) Size() (int64, error) {
 	}
 	return total, nil
 }
-
-func (db *Db) MergeSegments() error {
-	tmpPath := filepath.Join(db.dir, "merged.tmp")
-	tmpFile, err := os.Create(tmpPath)
-	if err != nil {
-		return err
-	}
-	writer := bufio.NewWriter(tmpFile)
-
-	latest := make(map[string]string)
-
-	entries, err := os.ReadDir(db.dir)
-	if err != nil {
-		tmpFile.Close()
-		os.Remove(tmpPath)
-		return err
-	}
-
-	var segmentFiles []string
-	for _, entry := range entries {
-		if strings.HasPrefix(entry.Name(), "segment-") && strings.HasSuffix(entry.Name(), ".db") {
-			segmentFiles = append(segmentFiles, filepath.Join(db.dir, entry.Name()))
-		}
-	}
-	sort.Strings(segmentFiles)
-
-	for _, path := range segmentFiles {
-		f, err := os.Open(path)
-		if err != nil {
-			tmpFile.Close()
-			os.Remove(tmpPath)
-			return err
-		}
-		r := bufio.NewReader(f)
-		for {
-			var e entry
-			_, err := e.DecodeFromReader(r)
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				f.Close()
-				tmpFile.Close()
-				os.Remove(tmpPath)
-				return err
-			}
-			latest[e.key] = e.value
-		}
-		f.Close()
-	}
-
-	var offset int64
-	newIndex := make(hashIndex)
-
-	for key, value := range latest {
-		e := entry{key: key, value: value}
-		data := e.Encode()
-		if _, err := writer.Write(data); err != nil {
-			tmpFile.Close()
-			os.Remove(tmpPath)
-			return err
-		}
-		newIndex[key] = recordLocation{
-			segmentID: 0,
-			offset:    offset,
-		}
-		offset += int64(len(data))
-	}
-
-	if err := writer.Flush(); err != nil {
-		tmpFile.Close()
-		os.Remove(tmpPath)
-		return err
-	}
-	if err := tmpFile.Sync(); err != nil {
-		tmpFile.Close()
-		os.Remove(tmpPath)
-		return err
-	}
-	if err := tmpFile.Close(); err != nil {
-		os.Remove(tmpPath)
-		return err
-	}
-
-	if db.currentFile != nil {
-		db.currentFile.Close()
-	}
-
-	for _, path := range segmentFiles {
-		os.Remove(path)
-	}
-
-	finalPath := filepath.Join(db.dir, fmt.Sprintf(segmentFileFormat, 0))
-	if err := os.Rename(tmpPath, finalPath); err != nil {
-		return err
-	}
-
-	db.currentID = 0
-	db.index = newIndex
-	return db.openCurrentSegment()
-}
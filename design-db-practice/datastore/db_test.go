@@ -1,8 +1,14 @@
 package datastore
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -88,11 +94,8 @@ func TestDb(t *testing.T) {
 func TestSegmentSplitting(t *testing.T) {
 	tmp := t.TempDir()
 
-	origSize := maxSegmentSize
-	maxSegmentSize = 7
-	defer func() { maxSegmentSize = origSize }()
-
-	db, err := Open(tmp)
+	opts := Options{SegmentSize: 7}
+	db, err := OpenWithOptions(tmp, opts)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -127,9 +130,8 @@ func TestSegmentSplitting(t *testing.T) {
 func TestMergeSegments(t *testing.T) {
 	tmpDir := t.TempDir()
 
-	maxSegmentSize = 20
-
-	db, err := Open(tmpDir)
+	opts := Options{SegmentSize: 20}
+	db, err := OpenWithOptions(tmpDir, opts)
 	if err != nil {
 		t.Fatalf("Open failed: %v", err)
 	}
@@ -150,7 +152,7 @@ func TestMergeSegments(t *testing.T) {
 	}
 	segCount := 0
 	for _, f := range files {
-		if f.Name()[0:7] == "segment" {
+		if strings.HasPrefix(f.Name(), "segment") {
 			segCount++
 		}
 	}
@@ -169,12 +171,13 @@ func TestMergeSegments(t *testing.T) {
 	}
 	segCount = 0
 	for _, f := range files {
-		if f.Name()[0:7] == "segment" {
+		if strings.HasPrefix(f.Name(), "segment") {
 			segCount++
 		}
 	}
-	if segCount != 1 {
-		t.Fatalf("After merging have more than 1 segment, we have: %d", segCount)
+	// The merged segment plus the current one, which is never merged.
+	if segCount != 2 {
+		t.Fatalf("After merging expected 2 segments, we have: %d", segCount)
 	}
 
 	for i := 0; i < 10; i++ {
@@ -189,3 +192,270 @@ func TestMergeSegments(t *testing.T) {
 		}
 	}
 }
+
+func TestDelete(t *testing.T) {
+	tmp := t.TempDir()
+
+	opts := Options{SegmentSize: 20}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k2", "v2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Delete("k1"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := db.Get("k1"); err != ErrNotFound {
+		t.Errorf("Get after Delete: expected ErrNotFound, got %v", err)
+	}
+	if err := db.Delete("k1"); err != ErrNotFound {
+		t.Errorf("second Delete: expected ErrNotFound, got %v", err)
+	}
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenWithOptions(tmp, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("k1"); err != ErrNotFound {
+			t.Errorf("deleted key came back after reopen: %v", err)
+		}
+		if value, err := db.Get("k2"); err != nil || value != "v2" {
+			t.Errorf("Get(k2) = %q, %v", value, err)
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		// Seal the segment holding the tombstone so the merge covers it.
+		if err := db.Put("k3", "v3"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.MergeSegments(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("k1"); err != ErrNotFound {
+			t.Errorf("deleted key came back after merge: %v", err)
+		}
+
+		data, err := os.ReadFile(filepath.Join(tmp, fmt.Sprintf(segmentFileFormat, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "k1") {
+			t.Error("merged segment still contains the deleted key")
+		}
+	})
+}
+
+func TestHintFiles(t *testing.T) {
+	tmp := t.TempDir()
+
+	opts := Options{SegmentSize: 100}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if err := db.Put(k, strings.Repeat(k, 30)); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	hintPath := filepath.Join(tmp, fmt.Sprintf(hintFileFormat, 0))
+	if _, err := os.Stat(hintPath); err != nil {
+		t.Fatalf("no hint file for a sealed segment: %v", err)
+	}
+
+	// Break the size field of the first record in place: a full scan of the
+	// segment fails now, so Open can only succeed by reading the hint.
+	segmentPath := filepath.Join(tmp, fmt.Sprintf(segmentFileFormat, 0))
+	f, err := os.OpenFile(segmentPath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{5, 0, 0, 0}, segmentHeaderSize); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatalf("Open did not use the hint file: %v", err)
+	}
+	if value, err := db.Get("c"); err != nil || value != strings.Repeat("c", 30) {
+		t.Errorf("Get(c) = %q, %v", value, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// With a corrupted hint Open must fall back to the (broken) segment.
+	data, err := os.ReadFile(hintPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xff
+	if err := os.WriteFile(hintPath, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if db, err := OpenWithOptions(tmp, opts); err == nil {
+		db.Close()
+		t.Error("Open accepted a hint file with a bad checksum")
+	}
+}
+
+func TestMergeConcurrentWithReadsAndWrites(t *testing.T) {
+	tmp := t.TempDir()
+
+	opts := Options{SegmentSize: 200}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	const keys = 20
+	const rounds = 30
+	for i := 0; i < keys; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	errs := make(chan error, 3)
+	go func() {
+		defer close(done)
+		for r := 1; r <= rounds; r++ {
+			for i := 0; i < keys; i++ {
+				if err := db.Put(fmt.Sprintf("key%d", i), strconv.Itoa(r)); err != nil {
+					errs <- fmt.Errorf("Put during merge: %w", err)
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-done:
+				errs <- nil
+				return
+			default:
+			}
+			for i := 0; i < keys; i++ {
+				if _, err := db.Get(fmt.Sprintf("key%d", i)); err != nil {
+					errs <- fmt.Errorf("Get during merge: %w", err)
+					return
+				}
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-done:
+				errs <- nil
+				return
+			default:
+			}
+			if err := db.MergeSegments(); err != nil {
+				errs <- fmt.Errorf("MergeSegments: %w", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+
+	check := func() {
+		t.Helper()
+		for i := 0; i < keys; i++ {
+			value, err := db.Get(fmt.Sprintf("key%d", i))
+			if err != nil {
+				t.Fatalf("Get(key%d): %v", i, err)
+			}
+			if value != strconv.Itoa(rounds) {
+				t.Errorf("Get(key%d) = %s, want %d", i, value, rounds)
+			}
+		}
+	}
+	check()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check()
+}
+
+func TestCloseWhileWriting(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const writers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				if err := db.Put(fmt.Sprintf("key%d-%d", i, j), "value"); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+	if err := db.Put("first", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if !errors.Is(err, errClosed) {
+			t.Errorf("Put during Close = %v, want errClosed", err)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put("late", "value"); !errors.Is(err, errClosed) {
+			t.Fatalf("Put after Close = %v, want errClosed", err)
+		}
+	}
+	if err := db.Backup(io.Discard); !errors.Is(err, errClosed) {
+		t.Errorf("Backup after Close = %v, want errClosed", err)
+	}
+}
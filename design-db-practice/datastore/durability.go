@@ -0,0 +1,88 @@
+package datastore
+
+import (
+	"time"
+)
+
+// SyncMode selects when written records are flushed to stable storage.
+type SyncMode int
+
+const (
+	// SyncNever leaves flushing to the operating system. A Put can be lost
+	// if the machine crashes, but not if only the process dies.
+	SyncNever SyncMode = iota
+	// SyncAlways fsyncs before a Put is acknowledged. Writes that are
+	// pending at the same time share one fsync (group commit).
+	SyncAlways
+	// SyncInterval fsyncs the current segment every SyncPolicy.Interval,
+	// so at most that much of acknowledged writes can be lost.
+	SyncInterval
+)
+
+// SyncPolicy configures the durability of writes.
+type SyncPolicy struct {
+	Mode     SyncMode
+	Interval time.Duration
+}
+
+// maxGroupCommit limits how many pending writes share one fsync.
+const maxGroupCommit = 128
+
+// drainPending adds writes that are already waiting in putChan to the
+// group, without blocking.
+func (db *Db) drainPending(group []entryWithAck) []entryWithAck {
+	for len(group) < maxGroupCommit {
+		select {
+		case eAck, ok := <-db.putChan:
+			if !ok {
+				return group
+			}
+			group = append(group, eAck)
+		default:
+			return group
+		}
+	}
+	return group
+}
+
+// commitGroup writes the group and acknowledges every write in it after
+// a single fsync when the policy asks for one.
+func (db *Db) commitGroup(group []entryWithAck) {
+	errs := make([]error, len(group))
+	for i, eAck := range group {
+		if eAck.seal {
+			if db.currentOffset > segmentHeaderSize {
+				errs[i] = db.sealCurrent()
+			}
+			continue
+		}
+		errs[i] = db.writeEntry(eAck)
+	}
+	if db.opts.Sync.Mode == SyncAlways {
+		if err := db.syncCurrent(); err != nil {
+			for i := range errs {
+				if errs[i] == nil {
+					errs[i] = err
+				}
+			}
+		}
+	}
+	for i, eAck := range group {
+		eAck.ack <- errs[i]
+	}
+}
+
+// syncCurrent fsyncs the current segment if anything was written to it
+// since the last sync.
+func (db *Db) syncCurrent() error {
+	if !db.dirty {
+		return nil
+	}
+	if err := db.currentFile.Sync(); err != nil {
+		return err
+	}
+	db.dirty = false
+	db.syncCount.Add(1)
+	db.lastSync.Store(time.Now().UnixNano())
+	return nil
+}
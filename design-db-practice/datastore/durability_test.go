@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSyncAlwaysGroupCommit(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{Sync: SyncPolicy{Mode: SyncAlways}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	if err := db.Put("first", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.syncCount.Load(); n != 1 {
+		t.Fatalf("expected one fsync after a single Put, got %d", n)
+	}
+
+	// Holding the index lock stalls the write loop on the blocker write,
+	// so the others pile up in putChan and have to be committed as a group.
+	const writers = 10
+	db.indexMutex.Lock()
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- db.Put("blocker", "v")
+	}()
+	waitFor := func(cond func() bool) {
+		for deadline := time.Now().Add(5 * time.Second); !cond(); {
+			if time.Now().After(deadline) {
+				db.indexMutex.Unlock()
+				t.Fatal("timed out waiting for the write loop")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor(func() bool { return len(db.putChan) == 0 })
+	time.Sleep(10 * time.Millisecond)
+
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func(i int) {
+			errs <- db.Put(fmt.Sprintf("key%d", i), "v")
+		}(i)
+	}
+	waitFor(func() bool { return len(db.putChan) == writers })
+	db.indexMutex.Unlock()
+
+	if err := <-blocked; err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < writers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := db.syncCount.Load(); n != 3 {
+		t.Errorf("expected one fsync for %d queued writes, got %d", writers, n-2)
+	}
+}
+
+func TestSyncInterval(t *testing.T) {
+	db, err := OpenWithOptions(t.TempDir(), Options{Sync: SyncPolicy{Mode: SyncInterval, Interval: 5 * time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); db.syncCount.Load() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("the current segment was never synced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSyncNever(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.syncCount.Load(); n != 0 {
+		t.Errorf("expected no fsyncs, got %d", n)
+	}
+}
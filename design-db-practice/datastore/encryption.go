@@ -0,0 +1,136 @@
+package datastore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// ErrWrongKey is returned for records encrypted with a key the Db was not
+// given, which includes any encrypted record if it was given no key.
+var ErrWrongKey = errors.New("records are encrypted with a different key")
+
+// keyIDSize is the size of the key fingerprint stored in front of every
+// encrypted record, so that a wrong key is told apart from corrupt data.
+const keyIDSize = 4
+
+type keyID [keyIDSize]byte
+
+func newKeyID(key []byte) keyID {
+	sum := sha256.Sum256(key)
+	return keyID(sum[:keyIDSize])
+}
+
+// recordCipher encrypts records with AES-GCM. A nil *recordCipher neither
+// encrypts nor decrypts.
+//
+// An encrypted record is stored as a record with an empty key, the
+// flagEncrypted flag and the value (key ID 4) (nonce 12) (sealed record),
+// where the sealed record is the complete plain record. Batches are not
+// encrypted themselves; the records packed into them are, one by one, so
+// that their locations can still be read directly.
+type recordCipher struct {
+	// current encrypts new records; it is nil if only old keys were
+	// given, and then records are written in plain text.
+	current *keyID
+	keys    map[keyID]cipher.AEAD
+}
+
+// newRecordCipher returns the cipher for key and the previous keys records
+// may still be encrypted with, or nil if there are no keys at all.
+func newRecordCipher(key []byte, previous [][]byte) (*recordCipher, error) {
+	if len(key) == 0 && len(previous) == 0 {
+		return nil, nil
+	}
+	c := &recordCipher{keys: make(map[keyID]cipher.AEAD)}
+	for i, k := range append([][]byte{key}, previous...) {
+		if len(k) == 0 {
+			continue
+		}
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, fmt.Errorf("bad encryption key: %w", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("bad encryption key: %w", err)
+		}
+		id := newKeyID(k)
+		c.keys[id] = aead
+		if i == 0 {
+			c.current = &id
+		}
+	}
+	return c, nil
+}
+
+func (c *recordCipher) encrypts() bool {
+	return c != nil && c.current != nil
+}
+
+// encode encodes e, encrypted with the current key if there is one.
+func (c *recordCipher) encode(e entry) []byte {
+	if !c.encrypts() || e.isBatch() {
+		return e.Encode()
+	}
+	sealed := entry{value: string(c.seal(e.Encode())), flags: flagEncrypted}
+	return sealed.Encode()
+}
+
+// seal encrypts data with the current key.
+func (c *recordCipher) seal(data []byte) []byte {
+	aead := c.keys[*c.current]
+	res := make([]byte, keyIDSize+aead.NonceSize(), keyIDSize+aead.NonceSize()+len(data)+aead.Overhead())
+	copy(res, c.current[:])
+	nonce := res[keyIDSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(fmt.Errorf("cannot generate nonce: %w", err))
+	}
+	return aead.Seal(res, nonce, data, nil)
+}
+
+// open decrypts data sealed with any of the keys. It decrypts in place,
+// so data cannot be used afterwards.
+func (c *recordCipher) open(data []byte) ([]byte, error) {
+	if len(data) < keyIDSize {
+		return nil, fmt.Errorf("encrypted data is too short: %d bytes", len(data))
+	}
+	id := keyID(data[:keyIDSize])
+	var aead cipher.AEAD
+	if c != nil {
+		aead = c.keys[id]
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("%w: key %x is not known", ErrWrongKey, id)
+	}
+	data = data[keyIDSize:]
+	if len(data) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("encrypted data is too short: %d bytes", len(data))
+	}
+	nonce, sealed := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plain, err := aead.Open(sealed[:0], nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt: %w", err)
+	}
+	return plain, nil
+}
+
+// decrypt returns the plain record of an encrypted one and any other
+// record as it is.
+func (c *recordCipher) decrypt(e entry) (entry, error) {
+	if e.flags&flagEncrypted == 0 {
+		return e, nil
+	}
+	data, err := c.open([]byte(e.value))
+	if err != nil {
+		return entry{}, err
+	}
+	var plain entry
+	if err := plain.Decode(data); err != nil {
+		return entry{}, fmt.Errorf("bad encrypted record: %w", err)
+	}
+	return plain, nil
+}
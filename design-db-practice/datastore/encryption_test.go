@@ -0,0 +1,221 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryption(t *testing.T) {
+	tmp := t.TempDir()
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	// A record written before encryption was turned on.
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("plain-key", "plain-value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := Options{EncryptionKey: oldKey, CompressionThreshold: 16}
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	pairs := map[string]string{
+		"plain-key":  "plain-value",
+		"secret-key": "secret-value",
+		"long-key":   "secret-value secret-value secret-value",
+		"batch-key":  "batch-value",
+	}
+	for _, key := range []string{"secret-key", "long-key", "doomed-key"} {
+		if err := db.Put(key, pairs[key]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var batch WriteBatch
+	batch.Put("batch-key", pairs["batch-key"])
+	batch.Delete("doomed-key")
+	if err := db.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(t *testing.T) {
+		t.Helper()
+		for key, want := range pairs {
+			if got, err := db.Get(key); err != nil || got != want {
+				t.Errorf("Get(%s) = %q, %v, want %q", key, got, err, want)
+			}
+		}
+		if _, err := db.Get("doomed-key"); err != ErrNotFound {
+			t.Errorf("Get of a deleted key = %v, want ErrNotFound", err)
+		}
+	}
+	// seal writes the hint of the current segment and makes it mergeable.
+	seal := func(t *testing.T) {
+		t.Helper()
+		if err := db.Backup(io.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reopen := func(t *testing.T, opts Options) error {
+		t.Helper()
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenWithOptions(tmp, opts)
+		return err
+	}
+	check(t)
+	seal(t)
+
+	t.Run("nothing in plain text", func(t *testing.T) {
+		files, err := filepath.Glob(filepath.Join(tmp, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range files {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, secret := range []string{"secret", "batch"} {
+				if bytes.Contains(data, []byte(secret)) {
+					t.Errorf("%s contains %q", filepath.Base(path), secret)
+				}
+			}
+		}
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := reopen(t, opts); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		for _, opts := range []Options{{}, {EncryptionKey: newKey}} {
+			if err := reopen(t, opts); !errors.Is(err, ErrWrongKey) {
+				t.Errorf("Open with key %x = %v, want ErrWrongKey", opts.EncryptionKey, err)
+			}
+			// A failed open must not have repaired anything away.
+			db, err = OpenWithOptions(tmp, Options{EncryptionKey: oldKey})
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(t)
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		// A record under the old key in the segment that stays current.
+		pairs["late-key"] = "late-value"
+		if err := db.Put("late-key", pairs["late-key"]); err != nil {
+			t.Fatal(err)
+		}
+		if err := reopen(t, Options{EncryptionKey: newKey, PreviousKeys: [][]byte{oldKey}}); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+		pairs["secret-key"] = "rotated"
+		if err := db.Put("secret-key", pairs["secret-key"]); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.MergeSegments(); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+
+		if err := reopen(t, Options{EncryptionKey: newKey}); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+}
+
+func TestApplyReencrypts(t *testing.T) {
+	leader, err := OpenWithOptions(t.TempDir(), Options{EncryptionKey: bytes.Repeat([]byte{1}, 16)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = leader.Close()
+	})
+	followerOpts := Options{EncryptionKey: bytes.Repeat([]byte{2}, 16)}
+	followerDir := t.TempDir()
+	follower, err := OpenWithOptions(followerDir, followerOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = follower.Close()
+	})
+
+	// The follower cannot read the records of the leader without its key.
+	r, err := leader.OpenLog(follower.LogEnd())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := leader.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	record, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.Apply(record); !errors.Is(err, ErrWrongKey) {
+		t.Fatalf("Apply without the key of the leader = %v, want ErrWrongKey", err)
+	}
+	if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	followerOpts.PreviousKeys = [][]byte{leader.opts.EncryptionKey}
+	if follower, err = OpenWithOptions(followerDir, followerOpts); err != nil {
+		t.Fatal(err)
+	}
+	var batch WriteBatch
+	batch.Put("batched", "value")
+	if err := leader.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if err := follower.Apply(record); err != nil {
+			t.Fatal(err)
+		}
+		if record, err = r.Next(); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := follower.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// What the follower stored is readable with its own key alone.
+	followerOpts.PreviousKeys = nil
+	if follower, err = OpenWithOptions(followerDir, followerOpts); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"key", "batched"} {
+		if value, err := follower.Get(key); err != nil || value != "value" {
+			t.Errorf("Get(%s) = %q, %v", key, value, err)
+		}
+	}
+}
@@ -2,42 +2,234 @@ package datastore
 
 import (
 	"bufio"
-	"crypto/sha1"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 )
 
+const (
+	// flagTombstone marks a record that deletes its key.
+	flagTombstone byte = 1 << iota
+	// flagBatch marks a record whose value is a sequence of complete
+	// records written atomically by Db.Write.
+	flagBatch
+	// flagVersion means the meta section holds the version of the key.
+	flagVersion
+	// flagExpiry means the meta section holds the expiry time of the key.
+	flagExpiry
+	// flagSeq means the meta section holds the sequence number of the
+	// write.
+	flagSeq
+	// flagSeqMark marks a record without key and value that only keeps a
+	// sequence number on disk after a merge dropped its write.
+	flagSeqMark
+	// flagCompressed means the value is stored deflated.
+	flagCompressed
+	// flagEncrypted marks a record whose value is another record
+	// encrypted, see recordCipher.
+	flagEncrypted
+)
+
+// checksumSize is the size of the CRC-32C that ends every record.
+const checksumSize = 4
+
+// entryFixedSize is the size of a record without key, value and meta.
+const entryFixedSize = 12 + checksumSize
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
 type entry struct {
 	key, value string
-	hash       [20]byte
+	// checksum is set by Encode and Decode.
+	checksum uint32
+	flags    byte
+	version  uint64
+	// expiresAt is the expiry time in Unix nanoseconds, 0 if none.
+	expiresAt int64
+	// seq numbers the writes of a Db in order, 0 for records written
+	// before sequence numbers were introduced.
+	seq uint64
+	// detached is set for a large record decoded without its value, see
+	// decodeDetached; value is empty then.
+	detached bool
 }
 
-// 0           4    8     kl+8  kl+12     <-- offset
-// (full size) (kl) (key) (vl)  (value)
-// 4           4    ....  4     .....     <-- length
+// 0           4    8     kl+8  kl+12     kl+vl+12  <-- offset
+// (full size) (kl) (key) (vl)  (value)   (meta)    (checksum)
+// 4           4    ....  4     .....     ....      4        <-- length
+//
+// The checksum is the CRC-32C of everything before it, so damaged sizes
+// are caught as well as damaged data. Segments of format version 1 and
+// older ended records with the SHA-1 of key, value and meta instead, see
+// legacyChecksumSize.
+//
+// The meta section is empty for records without flags, so those are
+// identical to the ones written before meta was introduced. Otherwise it
+// starts with a flags byte, followed by the optional fields the flags ask
+// for, in flag order:
+//
+//	flagVersion  version (8)
+//	flagExpiry   expiry time in Unix nanoseconds (8)
+//	flagSeq      sequence number (8)
+//
+// Its length is whatever is left of the full size.
 
 func (e *entry) Encode() []byte {
-	kl, vl := len(e.key), len(e.value)
-	e.hash = sha1.Sum([]byte(e.key + e.value))
-	size := kl + vl + 12 + len(e.hash)
+	meta := e.encodeMeta()
+	kl, vl, ml := len(e.key), len(e.value), len(meta)
+	size := kl + vl + ml + entryFixedSize
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
 	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
 	copy(res[8:], e.key)
 	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
 	copy(res[kl+12:], e.value)
-	copy(res[kl+12+vl:], e.hash[:])
+	copy(res[kl+12+vl:], meta)
+	e.checksum = crc32.Checksum(res[:size-checksumSize], castagnoli)
+	binary.LittleEndian.PutUint32(res[size-checksumSize:], e.checksum)
 	return res
 }
 
-func (e *entry) Decode(input []byte) {
-	kl := int(binary.LittleEndian.Uint32(input[4:8]))
-	vl := int(binary.LittleEndian.Uint32(input[kl+8 : kl+12]))
-	e.key = string(input[8 : 8+kl])
-	e.value = string(input[kl+12 : kl+12+vl])
-	copy(e.hash[:], input[len(input)-20:])
+// verifyChecksum checks the checksum of an encoded record.
+func verifyChecksum(record []byte) error {
+	body := record[:len(record)-checksumSize]
+	if crc32.Checksum(body, castagnoli) != binary.LittleEndian.Uint32(record[len(body):]) {
+		return errChecksumMismatch
+	}
+	return nil
+}
+
+// Decode decodes a record after checking its checksum.
+func (e *entry) Decode(input []byte) error {
+	if len(input) < entryFixedSize {
+		return fmt.Errorf("record is too short: %d bytes", len(input))
+	}
+	if err := verifyChecksum(input); err != nil {
+		return err
+	}
+	key, value, meta, err := splitRecord(input, checksumSize)
+	if err != nil {
+		return err
+	}
+	e.key = string(key)
+	e.value = string(value)
+	if err := e.decodeMeta(meta); err != nil {
+		return err
+	}
+	e.checksum = binary.LittleEndian.Uint32(input[len(input)-checksumSize:])
+	return nil
+}
+
+// splitRecord returns the key, value and meta sections of an encoded
+// record that ends with a checksum of sumSize bytes.
+func splitRecord(record []byte, sumSize int) (key, value, meta []byte, err error) {
+	if len(record) < 12+sumSize {
+		return nil, nil, nil, fmt.Errorf("record is too short: %d bytes", len(record))
+	}
+	kl := int(binary.LittleEndian.Uint32(record[4:8]))
+	if kl > len(record)-12-sumSize {
+		return nil, nil, nil, fmt.Errorf("key length %d exceeds record size %d", kl, len(record))
+	}
+	vl := int(binary.LittleEndian.Uint32(record[kl+8 : kl+12]))
+	if vl > len(record)-12-sumSize-kl {
+		return nil, nil, nil, fmt.Errorf("value length %d exceeds record size %d", vl, len(record))
+	}
+	return record[8 : 8+kl], record[kl+12 : kl+12+vl], record[kl+12+vl : len(record)-sumSize], nil
+}
+
+// decodeValue returns the value of the encoded record after checking its
+// checksum, decrypting it with c if needed. The value points into record
+// unless it was compressed. An encrypted record is decrypted in place, so
+// record cannot be decoded again afterwards.
+func decodeValue(record []byte, c *recordCipher) ([]byte, error) {
+	if len(record) < entryFixedSize {
+		return nil, fmt.Errorf("record is too short: %d bytes", len(record))
+	}
+	if err := verifyChecksum(record); err != nil {
+		return nil, err
+	}
+	_, value, meta, err := splitRecord(record, checksumSize)
+	if err != nil {
+		return nil, err
+	}
+	if len(meta) == 0 {
+		return value, nil
+	}
+	if meta[0]&flagEncrypted != 0 {
+		plain, err := c.open(value)
+		if err != nil {
+			return nil, err
+		}
+		return decodeValue(plain, nil)
+	}
+	if meta[0]&flagCompressed != 0 {
+		return inflate(value)
+	}
+	return value, nil
+}
+
+func (e *entry) encodeMeta() []byte {
+	flags := e.flags &^ (flagVersion | flagExpiry | flagSeq)
+	if e.version != 0 {
+		flags |= flagVersion
+	}
+	if e.expiresAt != 0 {
+		flags |= flagExpiry
+	}
+	if e.seq != 0 {
+		flags |= flagSeq
+	}
+	if flags == 0 {
+		return nil
+	}
+	meta := []byte{flags}
+	if flags&flagVersion != 0 {
+		meta = binary.LittleEndian.AppendUint64(meta, e.version)
+	}
+	if flags&flagExpiry != 0 {
+		meta = binary.LittleEndian.AppendUint64(meta, uint64(e.expiresAt))
+	}
+	if flags&flagSeq != 0 {
+		meta = binary.LittleEndian.AppendUint64(meta, e.seq)
+	}
+	return meta
+}
+
+func (e *entry) decodeMeta(meta []byte) error {
+	e.flags, e.version, e.expiresAt, e.seq = 0, 0, 0, 0
+	if len(meta) == 0 {
+		return nil
+	}
+	e.flags, meta = meta[0], meta[1:]
+	if e.flags&flagVersion != 0 {
+		if len(meta) < 8 {
+			return fmt.Errorf("meta section is too short for a version")
+		}
+		e.version, meta = binary.LittleEndian.Uint64(meta), meta[8:]
+	}
+	if e.flags&flagExpiry != 0 {
+		if len(meta) < 8 {
+			return fmt.Errorf("meta section is too short for an expiry time")
+		}
+		e.expiresAt, meta = int64(binary.LittleEndian.Uint64(meta)), meta[8:]
+	}
+	if e.flags&flagSeq != 0 {
+		if len(meta) < 8 {
+			return fmt.Errorf("meta section is too short for a sequence number")
+		}
+		e.seq, meta = binary.LittleEndian.Uint64(meta), meta[8:]
+	}
+	return nil
+}
+
+func (e *entry) isTombstone() bool {
+	return e.flags&flagTombstone != 0
+}
+
+func (e *entry) isBatch() bool {
+	return e.flags&flagBatch != 0
 }
 
 func decodeString(v []byte) string {
@@ -51,19 +243,29 @@ func (e *entry) DecodeFromReader(in *bufio.Reader) (int, error) {
 	sizeBuf, err := in.Peek(4)
 	if err != nil {
 		if errors.Is(err, io.EOF) {
-			return 0, err
+			if len(sizeBuf) == 0 {
+				return 0, err
+			}
+			err = io.ErrUnexpectedEOF
 		}
 		return 0, fmt.Errorf("DecodeFromReader, cannot read size: %w", err)
 	}
-	buf := make([]byte, int(binary.LittleEndian.Uint32(sizeBuf)))
-	n, err := in.Read(buf[:])
+	size := int64(binary.LittleEndian.Uint32(sizeBuf))
+	if size < entryFixedSize {
+		return 0, fmt.Errorf("DecodeFromReader, record size %d is too small", size)
+	}
+	// The size may be damaged, so it is not trusted with an allocation
+	// larger than what records are read whole up to.
+	if size > largeRecordSize {
+		return e.decodeDetached(in, size)
+	}
+	buf := make([]byte, size)
+	n, err := io.ReadFull(in, buf)
 	if err != nil {
 		return n, fmt.Errorf("DecodeFromReader, cannot read record: %w", err)
 	}
-	e.Decode(buf)
+	if err := e.Decode(buf); err != nil {
+		return n, fmt.Errorf("DecodeFromReader, cannot decode record: %w", err)
+	}
 	return n, nil
 }
-
-func (e *entry) EncodeHash() [20]byte {
-	return sha1.Sum([]byte(e.key + e.value))
-}
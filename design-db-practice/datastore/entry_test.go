@@ -3,7 +3,9 @@ package datastore
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
 	"testing"
 )
 
@@ -24,13 +26,13 @@ func TestEntry_Encode(t *testing.T) {
 	if decoded.value != original.value {
 		t.Error("incorrect value")
 	}
-	if decoded.hash != original.hash {
-		t.Error("hash mismatch")
+	if decoded.checksum != original.checksum {
+		t.Error("checksum mismatch")
 	}
 }
 
 func TestReadValue(t *testing.T) {
-	original := entry{"key", "test-value", [20]byte{}}
+	original := entry{key: "key", value: "test-value"}
 
 	encoded := original.Encode()
 
@@ -43,8 +45,8 @@ func TestReadValue(t *testing.T) {
 	if decoded.value != original.value {
 		t.Error("value mismatch")
 	}
-	if decoded.hash != original.hash {
-		t.Error("hash mismatch")
+	if decoded.checksum != original.checksum {
+		t.Error("checksum mismatch")
 	}
 
 	decoded2 := entry{}
@@ -59,8 +61,8 @@ func TestReadValue(t *testing.T) {
 	if decoded2.value != original.value {
 		t.Error("value mismatch (DecodeFromReader)")
 	}
-	if decoded2.hash != original.hash {
-		t.Error("hash mismatch (DecodeFromReader)")
+	if decoded2.checksum != original.checksum {
+		t.Error("checksum mismatch (DecodeFromReader)")
 	}
 
 	if n != len(encoded) {
@@ -68,26 +70,29 @@ func TestReadValue(t *testing.T) {
 	}
 }
 
-func TestEntry_HashChange(t *testing.T) {
-	original := entry{"key", "value", [20]byte{}}
-	original.hash = original.EncodeHash()
+func TestEntry_ChecksumChange(t *testing.T) {
+	original := entry{key: "key", value: "value"}
+	original.Encode()
 
-	modified := entry{"key", "value_modified", [20]byte{}}
-	modified.hash = modified.EncodeHash()
+	modified := entry{key: "key", value: "value_modified"}
+	modified.Encode()
 
-	if bytes.Equal(original.hash[:], modified.hash[:]) {
-		t.Error("hashes should differ when value changes")
+	if original.checksum == modified.checksum {
+		t.Error("checksums should differ when value changes")
 	}
 }
 
-func TestEntry_EncodeDecodeHash(t *testing.T) {
+func TestEntry_EncodeDecodeChecksum(t *testing.T) {
 	e := entry{key: "testkey", value: "testvalue"}
 	encoded := e.Encode()
 
-	// hash має оновитися після Encode
-	expectedHash := sha1.Sum([]byte(e.key + e.value))
-	if !bytes.Equal(e.hash[:], expectedHash[:]) {
-		t.Fatalf("hash mismatch after Encode, got %x, want %x", e.hash, expectedHash)
+	// checksum має оновитися після Encode і покривати весь запис
+	expected := crc32.Checksum(encoded[:len(encoded)-4], crc32.MakeTable(crc32.Castagnoli))
+	if e.checksum != expected {
+		t.Fatalf("checksum mismatch after Encode, got %x, want %x", e.checksum, expected)
+	}
+	if stored := binary.LittleEndian.Uint32(encoded[len(encoded)-4:]); stored != expected {
+		t.Fatalf("stored checksum %x, want %x", stored, expected)
 	}
 
 	var e2 entry
@@ -99,18 +104,63 @@ func TestEntry_EncodeDecodeHash(t *testing.T) {
 	if e2.value != e.value {
 		t.Errorf("value mismatch, got %s, want %s", e2.value, e.value)
 	}
-	if !bytes.Equal(e2.hash[:], expectedHash[:]) {
-		t.Errorf("hash mismatch after Decode, got %x, want %x", e2.hash, expectedHash)
+	if e2.checksum != expected {
+		t.Errorf("checksum mismatch after Decode, got %x, want %x", e2.checksum, expected)
 	}
 }
 
-func TestEntry_HashChangesOnValueChange(t *testing.T) {
+func TestEntry_ChecksumChangesOnValueChange(t *testing.T) {
 	e1 := entry{key: "key", value: "value"}
 	e1.Encode()
 	e2 := entry{key: "key", value: "value2"}
 	e2.Encode()
 
-	if bytes.Equal(e1.hash[:], e2.hash[:]) {
-		t.Error("hash should differ if value changes")
+	if e1.checksum == e2.checksum {
+		t.Error("checksum should differ if value changes")
+	}
+}
+
+func TestEntry_Tombstone(t *testing.T) {
+	original := entry{key: "key", flags: flagTombstone}
+	encoded := original.Encode()
+
+	var decoded entry
+	if err := decoded.Decode(encoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.isTombstone() {
+		t.Error("tombstone flag lost after Decode")
+	}
+	if decoded.key != original.key {
+		t.Errorf("key mismatch, got %s, want %s", decoded.key, original.key)
+	}
+	if decoded.checksum != original.checksum {
+		t.Error("checksum mismatch for tombstone")
+	}
+
+	plain := entry{key: "key"}
+	plain.Encode()
+	if plain.checksum == original.checksum {
+		t.Error("tombstone and empty value should not share a checksum")
+	}
+}
+
+func TestEntry_DecodeMalformed(t *testing.T) {
+	e := entry{key: "key", value: "value"}
+	encoded := e.Encode()
+
+	var decoded entry
+	if err := decoded.Decode(encoded[:10]); err == nil {
+		t.Error("expected error for truncated record")
+	}
+	broken := append([]byte(nil), encoded...)
+	broken[4] = 0xff
+	if err := decoded.Decode(broken); !errors.Is(err, errChecksumMismatch) {
+		t.Errorf("Decode with a bad key length = %v, want errChecksumMismatch", err)
+	}
+	broken = append([]byte(nil), encoded...)
+	broken[bytes.Index(broken, []byte("value"))] ^= 0xff
+	if err := decoded.Decode(broken); !errors.Is(err, errChecksumMismatch) {
+		t.Errorf("Decode with a damaged value = %v, want errChecksumMismatch", err)
 	}
 }
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package datastore
+
+import (
+	"errors"
+	"os"
+)
+
+var errWouldBlock = errors.New("lock is held")
+
+// flock does nothing where flock(2) is not available, so the directory is
+// not protected from concurrent use there.
+func flock(f *os.File, exclusive bool) error {
+	return nil
+}
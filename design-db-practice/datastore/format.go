@@ -0,0 +1,237 @@
+package datastore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrUnknownFormat is returned by Open for a segment written in a format
+// this version cannot read, usually by a newer version.
+var ErrUnknownFormat = errors.New("segment has an unknown format")
+
+// segmentMagic starts every segment file that has a header. Read as the
+// size of a first record it would be over a gigabyte, so a segment
+// without a header is not mistaken for one.
+var segmentMagic = [4]byte{'K', 'V', 'S', 'G'}
+
+// segmentFormatVersion is the format of new segments. Open upgrades
+// older ones: version 0 stands for the segments written before there were
+// headers, and up to version 1 records ended with a SHA-1 instead of a
+// CRC-32C.
+const segmentFormatVersion uint16 = 2
+
+// legacyChecksumSize is the size of the SHA-1 of key, value and meta that
+// ended records up to format version 1.
+const legacyChecksumSize = sha1.Size
+
+// segmentRewritten marks a segment written by a merge or an upgrade. Its
+// records are not where the write log put them, so it cannot be read as
+// the log.
+const segmentRewritten uint16 = 1 << 0
+
+// knownSegmentFlags are the header flags this version understands. Flags
+// are meant for changes that older versions must not read past.
+const knownSegmentFlags = segmentRewritten
+
+// segmentHeaderSize is the size of the header, which is where the first
+// record of a segment starts.
+const segmentHeaderSize = 16
+
+// Segment header layout:
+//
+// 0       4         6       8
+// (magic) (version) (flags) (created)
+// 4       2         2       8
+//
+// created is the time the segment was started, in Unix nanoseconds.
+
+type segmentHeader struct {
+	version uint16
+	flags   uint16
+	created time.Time
+}
+
+func newSegmentHeader() segmentHeader {
+	return segmentHeader{version: segmentFormatVersion, created: time.Now()}
+}
+
+func (h segmentHeader) encode() []byte {
+	res := make([]byte, segmentHeaderSize)
+	copy(res, segmentMagic[:])
+	binary.LittleEndian.PutUint16(res[4:], h.version)
+	binary.LittleEndian.PutUint16(res[6:], h.flags)
+	binary.LittleEndian.PutUint64(res[8:], uint64(h.created.UnixNano()))
+	return res
+}
+
+// readSegmentHeader reads and checks the header at the start of r. A
+// header cut short is reported as a *CorruptRecordError at offset 0, so
+// that a crash while a segment was started can be repaired like a torn
+// record.
+func readSegmentHeader(id int, r io.Reader) (segmentHeader, error) {
+	buf := make([]byte, segmentHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return segmentHeader{}, &CorruptRecordError{SegmentID: id, Offset: 0, Err: fmt.Errorf("cannot read header: %w", err)}
+	}
+	if [4]byte(buf) != segmentMagic {
+		return segmentHeader{}, fmt.Errorf("segment %d: %w: no header", id, ErrUnknownFormat)
+	}
+	h := segmentHeader{
+		version: binary.LittleEndian.Uint16(buf[4:]),
+		flags:   binary.LittleEndian.Uint16(buf[6:]),
+		created: time.Unix(0, int64(binary.LittleEndian.Uint64(buf[8:]))),
+	}
+	if h.version != segmentFormatVersion {
+		return segmentHeader{}, fmt.Errorf("segment %d: %w: version %d", id, ErrUnknownFormat, h.version)
+	}
+	if h.flags&^knownSegmentFlags != 0 {
+		return segmentHeader{}, fmt.Errorf("segment %d: %w: flags %#x", id, ErrUnknownFormat, h.flags)
+	}
+	return h, nil
+}
+
+// checkSegmentHeader checks that a segment has a header of the current
+// format.
+func (db *Db) checkSegmentHeader(id int) error {
+	f, err := os.Open(db.segmentPath(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = readSegmentHeader(id, f)
+	return err
+}
+
+// upgradeSegment rewrites a segment of an older format into the current
+// one and reports whether its records moved. The hint of the segment is
+// removed, as its offsets are off then.
+//
+// Records are copied up to the first one that cannot be decoded; that one
+// and the rest are kept as they are, so that Open deals with them like
+// with any other corrupt record.
+func (db *Db) upgradeSegment(id int) (bool, error) {
+	path := db.segmentPath(id)
+	in, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	// Only the header is read unless the segment needs an upgrade, so
+	// that Open does not read every segment whole.
+	buf := make([]byte, segmentHeaderSize)
+	n, err := io.ReadFull(in, buf)
+	in.Close()
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	if n == segmentHeaderSize && [4]byte(buf) == segmentMagic && binary.LittleEndian.Uint16(buf[4:]) != 1 {
+		// Current, or unknown and rejected by readSegmentHeader.
+		return false, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	header := newSegmentHeader()
+	if len(data) >= segmentHeaderSize && [4]byte(data) == segmentMagic {
+		header.created = time.Unix(0, int64(binary.LittleEndian.Uint64(data[8:])))
+		data = data[segmentHeaderSize:]
+	}
+
+	if len(data) > 0 {
+		header.flags |= segmentRewritten
+	}
+	upgraded := header.encode()
+	rest := data
+	for len(rest) >= 4 {
+		size := int(binary.LittleEndian.Uint32(rest))
+		if size < 12+legacyChecksumSize || size > len(rest) {
+			break
+		}
+		e, err := db.upgradeRecord(rest[:size])
+		if errors.Is(err, ErrWrongKey) {
+			return false, fmt.Errorf("cannot upgrade segment %d: %w", id, err)
+		}
+		if err != nil {
+			break
+		}
+		upgraded = append(upgraded, db.cipher.encode(e)...)
+		rest = rest[size:]
+	}
+	upgraded = append(upgraded, rest...)
+
+	tmpPath := filepath.Join(db.dir, "upgraded.tmp")
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, db.opts.FileMode)
+	if err != nil {
+		return false, err
+	}
+	_, err = f.Write(upgraded)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return false, fmt.Errorf("cannot upgrade segment %d: %w", id, err)
+	}
+	os.Remove(db.hintPath(id))
+	return len(data) > 0, nil
+}
+
+// upgradeRecord decodes a record written up to format version 1. It
+// returns encrypted records decrypted and batches with the records they
+// pack encoded in the current format, ready for recordCipher.encode.
+func (db *Db) upgradeRecord(record []byte) (entry, error) {
+	key, value, meta, err := splitRecord(record, legacyChecksumSize)
+	if err != nil {
+		return entry{}, err
+	}
+	h := sha1.New()
+	h.Write(key)
+	h.Write(value)
+	h.Write(meta)
+	if !bytes.Equal(h.Sum(nil), record[len(record)-legacyChecksumSize:]) {
+		return entry{}, errChecksumMismatch
+	}
+	e := entry{key: string(key), value: string(value)}
+	if err := e.decodeMeta(meta); err != nil {
+		return entry{}, err
+	}
+
+	switch {
+	case e.flags&flagEncrypted != 0:
+		plain, err := db.cipher.open(value)
+		if err != nil {
+			return entry{}, err
+		}
+		return db.upgradeRecord(plain)
+	case e.isBatch():
+		var packed []byte
+		for rest := value; len(rest) > 0; {
+			if len(rest) < 4 || int(binary.LittleEndian.Uint32(rest)) > len(rest) {
+				return entry{}, fmt.Errorf("record in batch exceeds the batch")
+			}
+			size := int(binary.LittleEndian.Uint32(rest))
+			inner, err := db.upgradeRecord(rest[:size])
+			if err != nil {
+				return entry{}, err
+			}
+			packed = append(packed, db.cipher.encode(inner)...)
+			rest = rest[size:]
+		}
+		e.value = string(packed)
+	}
+	return e, nil
+}
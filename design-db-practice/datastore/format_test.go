@@ -0,0 +1,141 @@
+package datastore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// encodeLegacy encodes e the way segments up to format version 1 did.
+func encodeLegacy(e entry) []byte {
+	meta := e.encodeMeta()
+	res := binary.LittleEndian.AppendUint32(nil, uint32(12+len(e.key)+len(e.value)+len(meta)+legacyChecksumSize))
+	res = binary.LittleEndian.AppendUint32(res, uint32(len(e.key)))
+	res = append(res, e.key...)
+	res = binary.LittleEndian.AppendUint32(res, uint32(len(e.value)))
+	res = append(res, e.value...)
+	res = append(res, meta...)
+	sum := sha1.Sum([]byte(e.key + e.value + string(meta)))
+	return append(res, sum[:]...)
+}
+
+func TestUpgradeSegments(t *testing.T) {
+	tmp := t.TempDir()
+	db := &Db{dir: tmp}
+	// Segments as they were written before they had headers, and with the
+	// first header version.
+	writeLegacy := func(id int, header []byte, entries ...entry) {
+		t.Helper()
+		data := header
+		for _, e := range entries {
+			data = append(data, encodeLegacy(e)...)
+		}
+		if err := os.WriteFile(db.segmentPath(id), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeLegacy(0, nil,
+		entry{key: "a", value: "old", version: 1, seq: 1},
+		entry{key: "b", value: "kept", version: 1, seq: 2},
+	)
+	batch := entry{flags: flagBatch, value: string(encodeLegacy(entry{key: "a", value: "new", version: 2, seq: 3}))}
+	writeLegacy(1, segmentHeader{version: 1, created: time.Now()}.encode(), batch)
+
+	before := time.Now()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	check := func(t *testing.T) {
+		t.Helper()
+		for key, want := range map[string]string{"a": "new", "b": "kept"} {
+			if got, err := db.Get(key); err != nil || got != want {
+				t.Errorf("Get(%s) = %q, %v, want %q", key, got, err, want)
+			}
+		}
+	}
+	check(t)
+	if db.LastSeq() != 3 {
+		t.Errorf("LastSeq = %d, want 3", db.LastSeq())
+	}
+
+	for _, id := range []int{0, 1, 2} {
+		f, err := os.Open(db.segmentPath(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, err := readSegmentHeader(id, f)
+		f.Close()
+		if err != nil {
+			t.Errorf("segment %d: %v", id, err)
+		} else if h.version != segmentFormatVersion || h.created.Before(before.Add(-time.Second)) {
+			t.Errorf("segment %d has header %+v", id, h)
+		}
+	}
+
+	t.Run("log starts after the upgrade", func(t *testing.T) {
+		if _, err := db.OpenLog(LogPosition{Segment: 1}); !errors.Is(err, ErrLogUnavailable) {
+			t.Errorf("OpenLog in the upgraded segment = %v, want ErrLogUnavailable", err)
+		}
+		r, err := db.OpenLog(LogPosition{Segment: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		if err := db.Put("c", "after"); err != nil {
+			t.Fatal(err)
+		}
+		record, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var e entry
+		if err := e.Decode(record); err != nil || e.key != "c" {
+			t.Errorf("first record after the upgrade = %+v, %v", e, err)
+		}
+	})
+
+	t.Run("merge and reopen", func(t *testing.T) {
+		if err := db.MergeSegments(); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = Open(tmp); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+}
+
+func TestUnknownSegmentFormat(t *testing.T) {
+	for _, h := range []segmentHeader{
+		{version: segmentFormatVersion + 1},
+		{version: segmentFormatVersion, flags: 1 << 15},
+	} {
+		tmp := t.TempDir()
+		db := &Db{dir: tmp}
+		data := h.encode()
+		if err := os.WriteFile(db.segmentPath(0), data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if db, err := Open(tmp); !errors.Is(err, ErrUnknownFormat) {
+			if err == nil {
+				db.Close()
+			}
+			t.Errorf("Open of a segment with header %+v = %v, want ErrUnknownFormat", h, err)
+		}
+		if got, _ := os.ReadFile(db.segmentPath(0)); !bytes.Equal(got, data) {
+			t.Errorf("Open changed a segment with header %+v", h)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+)
+
+const hintFileFormat = "hint-%06d.idx"
+
+// hintVersion is bumped whenever the layout of hint entries changes, so
+// stale hint files are ignored instead of being misread.
+const hintVersion byte = 4
+
+// hintSealed starts a hint file whose content is encrypted, see
+// writeHintFile.
+const hintSealed byte = 0x80
+
+// hintEntryFixedSize is the size of a hint entry without its key.
+const hintEntryFixedSize = 41
+
+var errBadHint = errors.New("hint file is invalid")
+
+// hintEntry describes a single record of a segment without its value.
+type hintEntry struct {
+	key       string
+	offset    int64
+	size      int
+	flags     byte
+	version   uint64
+	expiresAt int64
+	seq       uint64
+}
+
+func newHintEntry(e entry, loc recordLocation) hintEntry {
+	return hintEntry{
+		key:       e.key,
+		offset:    loc.offset,
+		size:      loc.size,
+		flags:     e.flags,
+		version:   e.version,
+		expiresAt: e.expiresAt,
+		seq:       e.seq,
+	}
+}
+
+// Hint file layout:
+//
+// 0         1              9
+// (version) (segment size) (entries...) (crc32)
+// 1         8              ....         4
+//
+// Every entry is (kl 4) (key) (offset 8) (size 4) (flags 1) (version 8)
+// (expiry 8) (seq 8).
+// The segment size lets a hint be rejected when its segment was changed
+// afterwards.
+
+func encodeHint(segmentSize int64, entries []hintEntry) []byte {
+	size := 9 + 4
+	for _, he := range entries {
+		size += len(he.key) + hintEntryFixedSize
+	}
+	res := make([]byte, 9, size)
+	res[0] = hintVersion
+	binary.LittleEndian.PutUint64(res[1:], uint64(segmentSize))
+	for _, he := range entries {
+		res = binary.LittleEndian.AppendUint32(res, uint32(len(he.key)))
+		res = append(res, he.key...)
+		res = binary.LittleEndian.AppendUint64(res, uint64(he.offset))
+		res = binary.LittleEndian.AppendUint32(res, uint32(he.size))
+		res = append(res, he.flags)
+		res = binary.LittleEndian.AppendUint64(res, he.version)
+		res = binary.LittleEndian.AppendUint64(res, uint64(he.expiresAt))
+		res = binary.LittleEndian.AppendUint64(res, he.seq)
+	}
+	return binary.LittleEndian.AppendUint32(res, crc32.ChecksumIEEE(res))
+}
+
+func decodeHint(data []byte) (int64, []hintEntry, error) {
+	if len(data) < 13 {
+		return 0, nil, errBadHint
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(body):]) {
+		return 0, nil, fmt.Errorf("%w: checksum mismatch", errBadHint)
+	}
+	if body[0] != hintVersion {
+		return 0, nil, fmt.Errorf("%w: unknown version %d", errBadHint, body[0])
+	}
+	segmentSize := int64(binary.LittleEndian.Uint64(body[1:]))
+
+	var entries []hintEntry
+	for rest := body[9:]; len(rest) > 0; {
+		if len(rest) < 4 {
+			return 0, nil, errBadHint
+		}
+		kl := int(binary.LittleEndian.Uint32(rest))
+		if len(rest) < kl+hintEntryFixedSize {
+			return 0, nil, errBadHint
+		}
+		entries = append(entries, hintEntry{
+			key:       string(rest[4 : 4+kl]),
+			offset:    int64(binary.LittleEndian.Uint64(rest[4+kl:])),
+			size:      int(binary.LittleEndian.Uint32(rest[12+kl:])),
+			flags:     rest[16+kl],
+			version:   binary.LittleEndian.Uint64(rest[17+kl:]),
+			expiresAt: int64(binary.LittleEndian.Uint64(rest[25+kl:])),
+			seq:       binary.LittleEndian.Uint64(rest[33+kl:]),
+		})
+		rest = rest[kl+hintEntryFixedSize:]
+	}
+	return segmentSize, entries, nil
+}
+
+// writeHintFile atomically replaces the hint file at path. Hints hold the
+// keys of the segment, so if c encrypts, the file is hintSealed followed
+// by the encrypted hint.
+func writeHintFile(path string, perm os.FileMode, c *recordCipher, segmentSize int64, entries []hintEntry) error {
+	data := encodeHint(segmentSize, entries)
+	if c.encrypts() {
+		data = append([]byte{hintSealed}, c.seal(data)...)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, perm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// readHintFile returns the entries of a hint file if it is intact and was
+// written for a segment of the given size.
+func readHintFile(path string, c *recordCipher, segmentSize int64) ([]hintEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 && data[0] == hintSealed {
+		if data, err = c.open(data[1:]); err != nil {
+			return nil, fmt.Errorf("%w: %w", errBadHint, err)
+		}
+	}
+	hintSegmentSize, entries, err := decodeHint(data)
+	if err != nil {
+		return nil, err
+	}
+	if hintSegmentSize != segmentSize {
+		return nil, fmt.Errorf("%w: written for %d bytes, segment has %d", errBadHint, hintSegmentSize, segmentSize)
+	}
+	return entries, nil
+}
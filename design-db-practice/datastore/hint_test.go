@@ -0,0 +1,42 @@
+package datastore
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHint_EncodeDecode(t *testing.T) {
+	entries := []hintEntry{
+		{key: "k1", offset: 0, size: 40},
+		{key: "k2", offset: 40, size: 41},
+		{key: "k1", offset: 81, size: 35, flags: flagTombstone, seq: 3},
+	}
+
+	segmentSize, decoded, err := decodeHint(encodeHint(116, entries))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if segmentSize != 116 {
+		t.Errorf("segment size = %d, want 116", segmentSize)
+	}
+	if len(decoded) != len(entries) {
+		t.Fatalf("decoded %d entries, want %d", len(decoded), len(entries))
+	}
+	for i := range entries {
+		if decoded[i] != entries[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, decoded[i], entries[i])
+		}
+	}
+}
+
+func TestHint_Corrupted(t *testing.T) {
+	data := encodeHint(10, []hintEntry{{key: "key", offset: 0, size: 10}})
+
+	data[5] ^= 0xff
+	if _, _, err := decodeHint(data); !errors.Is(err, errBadHint) {
+		t.Errorf("expected errBadHint for flipped byte, got %v", err)
+	}
+	if _, _, err := decodeHint(data[:8]); !errors.Is(err, errBadHint) {
+		t.Errorf("expected errBadHint for truncated file, got %v", err)
+	}
+}
@@ -0,0 +1,183 @@
+package datastore
+
+import (
+	"maps"
+	"math/rand/v2"
+	"sort"
+)
+
+// keyIndex maps keys to the location of their latest record. It is not
+// safe for concurrent use; Db guards it with indexMutex.
+type keyIndex interface {
+	get(key string) (recordLocation, bool)
+	set(key string, loc recordLocation)
+	remove(key string)
+	len() int
+	// ascend calls fn for every key not less than start in ascending order
+	// until fn returns false.
+	ascend(start string, fn func(key string, loc recordLocation) bool)
+	clone() keyIndex
+}
+
+func newIndex(opts Options) keyIndex {
+	if opts.OrderedIndex {
+		return newOrderedIndex()
+	}
+	return make(hashIndex)
+}
+
+// sortingIndex is implemented by indexes that have to sort keys to walk
+// them in order. An Iterator sorts the keys it walks once with sortedKeys
+// instead of calling ascend for every batch.
+type sortingIndex interface {
+	// sortedKeys returns the keys in [start, end) in ascending order. An
+	// empty end means no upper bound.
+	sortedKeys(start, end string) []string
+}
+
+// hashIndex is the default index. Lookups are cheap, but ascend has to
+// sort the matching keys on every call.
+type hashIndex map[string]recordLocation
+
+func (h hashIndex) get(key string) (recordLocation, bool) {
+	loc, ok := h[key]
+	return loc, ok
+}
+
+func (h hashIndex) set(key string, loc recordLocation) {
+	h[key] = loc
+}
+
+func (h hashIndex) remove(key string) {
+	delete(h, key)
+}
+
+func (h hashIndex) len() int {
+	return len(h)
+}
+
+func (h hashIndex) clone() keyIndex {
+	return maps.Clone(h)
+}
+
+func (h hashIndex) sortedKeys(start, end string) []string {
+	var keys []string
+	for key := range h {
+		if key >= start && (end == "" || key < end) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (h hashIndex) ascend(start string, fn func(key string, loc recordLocation) bool) {
+	for _, key := range h.sortedKeys(start, "") {
+		if !fn(key, h[key]) {
+			return
+		}
+	}
+}
+
+const skipListMaxLevel = 24
+
+type skipNode struct {
+	key  string
+	loc  recordLocation
+	next []*skipNode
+}
+
+// orderedIndex keeps keys sorted in a skip list, so range scans only visit
+// the keys they return.
+type orderedIndex struct {
+	head  *skipNode
+	level int
+	size  int
+}
+
+func newOrderedIndex() *orderedIndex {
+	return &orderedIndex{
+		head:  &skipNode{next: make([]*skipNode, skipListMaxLevel)},
+		level: 1,
+	}
+}
+
+// seek returns the first node with a key not less than key. If update is
+// set, it receives the last node before that one on every level.
+func (s *orderedIndex) seek(key string, update *[skipListMaxLevel]*skipNode) *skipNode {
+	x := s.head
+	for i := s.level - 1; i >= 0; i-- {
+		for x.next[i] != nil && x.next[i].key < key {
+			x = x.next[i]
+		}
+		if update != nil {
+			update[i] = x
+		}
+	}
+	return x.next[0]
+}
+
+func (s *orderedIndex) get(key string) (recordLocation, bool) {
+	if n := s.seek(key, nil); n != nil && n.key == key {
+		return n.loc, true
+	}
+	return recordLocation{}, false
+}
+
+func (s *orderedIndex) set(key string, loc recordLocation) {
+	var update [skipListMaxLevel]*skipNode
+	if n := s.seek(key, &update); n != nil && n.key == key {
+		n.loc = loc
+		return
+	}
+
+	level := 1
+	for level < skipListMaxLevel && rand.Uint32()&3 == 0 {
+		level++
+	}
+	for ; s.level < level; s.level++ {
+		update[s.level] = s.head
+	}
+	node := &skipNode{key: key, loc: loc, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	s.size++
+}
+
+func (s *orderedIndex) remove(key string) {
+	var update [skipListMaxLevel]*skipNode
+	n := s.seek(key, &update)
+	if n == nil || n.key != key {
+		return
+	}
+	for i := 0; i < s.level && update[i].next[i] == n; i++ {
+		update[i].next[i] = n.next[i]
+	}
+	for s.level > 1 && s.head.next[s.level-1] == nil {
+		s.level--
+	}
+	s.size--
+}
+
+func (s *orderedIndex) len() int {
+	return s.size
+}
+
+func (s *orderedIndex) ascend(start string, fn func(key string, loc recordLocation) bool) {
+	for n := s.seek(start, nil); n != nil; n = n.next[0] {
+		if !fn(n.key, n.loc) {
+			return
+		}
+	}
+}
+
+func (s *orderedIndex) clone() keyIndex {
+	c := newOrderedIndex()
+	s.ascend("", func(key string, loc recordLocation) bool {
+		c.set(key, loc)
+		return true
+	})
+	return c
+}
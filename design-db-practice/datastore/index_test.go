@@ -0,0 +1,54 @@
+package datastore
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+)
+
+func TestOrderedIndex(t *testing.T) {
+	idx := newOrderedIndex()
+	want := make(hashIndex)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key-%d", rand.IntN(500))
+		if rand.IntN(3) == 0 {
+			idx.remove(key)
+			want.remove(key)
+		} else {
+			loc := recordLocation{segmentID: i}
+			idx.set(key, loc)
+			want.set(key, loc)
+		}
+	}
+
+	if idx.len() != want.len() {
+		t.Errorf("len = %d, want %d", idx.len(), want.len())
+	}
+	for key, loc := range want {
+		if got, ok := idx.get(key); !ok || got != loc {
+			t.Errorf("get(%s) = %v, %t, want %v", key, got, ok, loc)
+		}
+	}
+	if _, ok := idx.get("missing"); ok {
+		t.Error("get found a missing key")
+	}
+
+	collect := func(index keyIndex, start string) []string {
+		var keys []string
+		index.ascend(start, func(key string, _ recordLocation) bool {
+			keys = append(keys, key)
+			return true
+		})
+		return keys
+	}
+	for _, start := range []string{"", "key-2", "key-250", "z"} {
+		got, expected := collect(idx, start), collect(want, start)
+		if !slices.Equal(got, expected) {
+			t.Errorf("ascend(%q) = %v, want %v", start, got, expected)
+		}
+		if !slices.IsSorted(got) {
+			t.Errorf("ascend(%q) is not sorted", start)
+		}
+	}
+}
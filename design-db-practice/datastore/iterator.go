@@ -0,0 +1,149 @@
+package datastore
+
+import (
+	"sort"
+	"sync"
+)
+
+// iteratorBatchSize is the number of keys an Iterator reads per index
+// lock acquisition.
+const iteratorBatchSize = 64
+
+type kv struct {
+	key, value string
+}
+
+// Iterator walks keys of a Db in ascending order. It reads the index in
+// small batches, so writes made while iterating may or may not be seen.
+type Iterator struct {
+	// lock guards v while a batch is read.
+	lock    sync.Locker
+	v       *view
+	start   string
+	end     string
+	started bool
+	done    bool
+	// keys are the keys left to walk, sorted once if the index has to
+	// sort them, see sortingIndex.
+	keys     []string
+	haveKeys bool
+	buf      []kv
+	cur      kv
+	err      error
+}
+
+// Scan returns an iterator over the keys in [start, end). An empty end
+// means no upper bound.
+func (db *Db) Scan(start, end string) *Iterator {
+	return &Iterator{lock: db.indexMutex.RLocker(), v: &db.view, start: start, end: end}
+}
+
+// ScanPrefix returns an iterator over the keys that start with prefix.
+func (db *Db) ScanPrefix(prefix string) *Iterator {
+	return db.Scan(prefix, prefixEnd(prefix))
+}
+
+// prefixEnd returns the smallest key greater than every key with the given
+// prefix, or "" if there is none.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
+// Next advances the iterator and reports whether there is a current item.
+func (it *Iterator) Next() bool {
+	if len(it.buf) == 0 && !it.done && it.err == nil {
+		it.fill()
+	}
+	if len(it.buf) == 0 {
+		return false
+	}
+	it.cur, it.buf = it.buf[0], it.buf[1:]
+	return true
+}
+
+// Seek moves the iterator forward to the first key not less than key.
+// Keys before the current position are never revisited.
+func (it *Iterator) Seek(key string) {
+	for len(it.buf) > 0 && it.buf[0].key < key {
+		it.buf = it.buf[1:]
+	}
+	it.keys = it.keys[sort.SearchStrings(it.keys, key):]
+	if key > it.start {
+		it.start = key
+		it.started = false
+		it.done = false
+	}
+}
+
+// Key returns the key of the current item.
+func (it *Iterator) Key() string {
+	return it.cur.key
+}
+
+// Value returns the value of the current item.
+func (it *Iterator) Value() string {
+	return it.cur.value
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+func (it *Iterator) fill() {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+
+	now := it.v.now()
+	it.done = true
+	visit := func(key string, loc recordLocation) bool {
+		if it.started && key == it.start {
+			return true
+		}
+		if it.end != "" && key >= it.end {
+			return false
+		}
+		if len(it.buf) == iteratorBatchSize {
+			it.done = false
+			return false
+		}
+		if loc.expired(now) {
+			return true
+		}
+		value, err := it.v.readValue(loc)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.buf = append(it.buf, kv{key: key, value: value})
+		return true
+	}
+
+	sorting, ok := it.v.index.(sortingIndex)
+	if !ok {
+		it.v.index.ascend(it.start, visit)
+	} else {
+		if !it.haveKeys {
+			it.keys, it.haveKeys = sorting.sortedKeys(it.start, it.end), true
+		}
+		for len(it.keys) > 0 {
+			// Keys removed since they were sorted are skipped.
+			loc, ok := it.v.index.get(it.keys[0])
+			if ok && !visit(it.keys[0], loc) {
+				break
+			}
+			it.keys = it.keys[1:]
+		}
+	}
+	if n := len(it.buf); n > 0 {
+		it.start = it.buf[n-1].key
+		it.started = true
+	}
+}
@@ -0,0 +1,142 @@
+package datastore
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestScan(t *testing.T) {
+	for _, ordered := range []bool{false, true} {
+		t.Run(fmt.Sprintf("ordered=%t", ordered), func(t *testing.T) {
+			tmp := t.TempDir()
+			db, err := OpenWithOptions(tmp, Options{SegmentSize: 500, OrderedIndex: ordered})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				_ = db.Close()
+			})
+
+			var users []string
+			for i := 0; i < 150; i++ {
+				key := fmt.Sprintf("user:%03d", i)
+				users = append(users, key)
+				if err := db.Put(key, "v"+key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, key := range []string{"team", "user", "userz", "a"} {
+				if err := db.Put(key, "v"+key); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := db.Delete("user:010"); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.PutWithTTL("user:020", "gone", time.Nanosecond); err != nil {
+				t.Fatal(err)
+			}
+			users = slices.DeleteFunc(users, func(key string) bool {
+				return key == "user:010" || key == "user:020"
+			})
+
+			collect := func(it *Iterator) []string {
+				t.Helper()
+				var keys []string
+				for it.Next() {
+					if it.Value() != "v"+it.Key() {
+						t.Errorf("value of %s = %s", it.Key(), it.Value())
+					}
+					keys = append(keys, it.Key())
+				}
+				if err := it.Err(); err != nil {
+					t.Fatal(err)
+				}
+				return keys
+			}
+
+			if got := collect(db.ScanPrefix("user:")); !slices.Equal(got, users) {
+				t.Errorf("ScanPrefix(user:) = %v, want %v", got, users)
+			}
+			want := []string{"user:100", "user:101", "user:102"}
+			if got := collect(db.Scan("user:100", "user:103")); !slices.Equal(got, want) {
+				t.Errorf("Scan(user:100, user:103) = %v, want %v", got, want)
+			}
+			if got := collect(db.Scan("", "b")); !slices.Equal(got, []string{"a"}) {
+				t.Errorf("Scan(, b) = %v, want [a]", got)
+			}
+			if got := collect(db.Scan("user:149", "")); !slices.Equal(got, []string{"user:149", "userz"}) {
+				t.Errorf("Scan(user:149, ) = %v, want [user:149 userz]", got)
+			}
+
+			// A key deleted after the iterator started, in a later batch.
+			it := db.ScanPrefix("user:")
+			if !it.Next() {
+				t.Fatal("ScanPrefix(user:) is empty")
+			}
+			if err := db.Delete("user:140"); err != nil {
+				t.Fatal(err)
+			}
+			if got := collect(it); slices.Contains(got, "user:140") || len(got) != len(users)-2 {
+				t.Errorf("ScanPrefix(user:) after a delete = %v", got)
+			}
+		})
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	cases := map[string]string{
+		"":         "",
+		"abc":      "abd",
+		"a\xff":    "b",
+		"\xff\xff": "",
+	}
+	for prefix, want := range cases {
+		if got := prefixEnd(prefix); got != want {
+			t.Errorf("prefixEnd(%q) = %q, want %q", prefix, got, want)
+		}
+	}
+}
+
+func TestIteratorSeek(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithOptions(tmp, Options{OrderedIndex: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	for i := 0; i < 200; i++ {
+		if err := db.Put(fmt.Sprintf("k%03d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it := db.ScanPrefix("k")
+	it.Seek("k010")
+	if !it.Next() || it.Key() != "k010" {
+		t.Fatalf("after Seek(k010) got %q", it.Key())
+	}
+	// Within the buffered batch.
+	it.Seek("k020")
+	if !it.Next() || it.Key() != "k020" {
+		t.Fatalf("after Seek(k020) got %q", it.Key())
+	}
+	// Backwards seeks do not rewind.
+	it.Seek("k000")
+	if !it.Next() || it.Key() != "k021" {
+		t.Fatalf("after Seek(k000) got %q", it.Key())
+	}
+	// Past the buffered batch.
+	it.Seek("k150")
+	if !it.Next() || it.Key() != "k150" {
+		t.Fatalf("after Seek(k150) got %q", it.Key())
+	}
+	it.Seek("l")
+	if it.Next() {
+		t.Errorf("Next after seeking past the end returned %q", it.Key())
+	}
+}
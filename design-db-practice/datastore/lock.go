@@ -0,0 +1,39 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockFileName is the file in the database directory that Open locks, so
+// that only one process writes to the segments at a time.
+const lockFileName = "LOCK"
+
+// ErrLocked is returned by Open when another Db holds the directory: any
+// Db for a writable Open, and a writable one for a read-only Open. Locks
+// are held per open file, so this includes a Db of the same process.
+var ErrLocked = errors.New("database is locked by another process")
+
+// ErrReadOnly is returned by the writes of a Db opened with
+// Options.ReadOnly.
+var ErrReadOnly = errors.New("database is open read-only")
+
+// lockDir locks the directory, shared if exclusive is not set, and returns
+// the lock file. Closing it releases the lock.
+func lockDir(dir string, exclusive bool, perm os.FileMode) (*os.File, error) {
+	path := filepath.Join(dir, lockFileName)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, perm)
+	if err != nil {
+		return nil, err
+	}
+	if err := flock(f, exclusive); err != nil {
+		f.Close()
+		if errors.Is(err, errWouldBlock) {
+			return nil, fmt.Errorf("%w: %s", ErrLocked, dir)
+		}
+		return nil, fmt.Errorf("cannot lock %s: %w", path, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,126 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLock(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []Options{{}, {ReadOnly: true}} {
+		if other, err := OpenWithOptions(tmp, opts); !errors.Is(err, ErrLocked) {
+			if err == nil {
+				other.Close()
+			}
+			t.Errorf("second Open with %+v = %v, want ErrLocked", opts, err)
+		}
+	}
+	if err := Restore(bytes.NewReader(nil), tmp); !errors.Is(err, ErrLocked) {
+		t.Errorf("Restore into an open database = %v, want ErrLocked", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	readers := make([]*Db, 2)
+	for i := range readers {
+		if readers[i], err = OpenWithOptions(tmp, Options{ReadOnly: true}); err != nil {
+			t.Fatalf("read-only Open %d: %v", i, err)
+		}
+		defer readers[i].Close()
+	}
+	if writer, err := Open(tmp); !errors.Is(err, ErrLocked) {
+		if err == nil {
+			writer.Close()
+		}
+		t.Errorf("Open while read-only Dbs are open = %v, want ErrLocked", err)
+	}
+
+	for _, r := range readers {
+		r.Close()
+	}
+	if db, err = Open(tmp); err != nil {
+		t.Fatalf("Open after the others were closed: %v", err)
+	}
+	db.Close()
+}
+
+func TestReadOnly(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A torn record, as after a crash in the middle of a write.
+	f, err := os.OpenFile(db.segmentPath(0), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{100, 0, 0, 0, 1})
+	f.Close()
+	before, err := os.ReadFile(db.segmentPath(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenWithOptions(tmp, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got, err := db.Get("key"); err != nil || got != "value" {
+		t.Errorf("Get = %q, %v, want value", got, err)
+	}
+	if report := db.Recovery(); report == nil || report.DroppedBytes != 5 {
+		t.Errorf("Recovery = %v, want the torn record reported", report)
+	}
+
+	if err := db.Put("key", "other"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Put = %v, want ErrReadOnly", err)
+	}
+	if err := db.Delete("key"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Delete = %v, want ErrReadOnly", err)
+	}
+	if err := db.MergeSegments(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("MergeSegments = %v, want ErrReadOnly", err)
+	}
+	if after, _ := os.ReadFile(db.segmentPath(0)); !bytes.Equal(after, before) {
+		t.Error("read-only Open changed the segment")
+	}
+
+	var archive bytes.Buffer
+	if err := db.Backup(&archive); err != nil {
+		t.Fatalf("Backup = %v", err)
+	}
+	restoreDir := filepath.Join(t.TempDir(), "restored")
+	if err := Restore(&archive, restoreDir); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := Open(restoreDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if got, err := restored.Get("key"); err != nil || got != "value" {
+		t.Errorf("Get from the backup = %q, %v, want value", got, err)
+	}
+	if report := restored.Recovery(); report != nil {
+		t.Errorf("the backup holds the torn record: %v", report)
+	}
+}
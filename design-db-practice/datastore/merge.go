@@ -0,0 +1,315 @@
+package datastore
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// movedRecord remembers where a live record was copied by a merge, or
+// that it was dropped because it expired.
+type movedRecord struct {
+	key      string
+	from, to recordLocation
+	expired  bool
+}
+
+// mergeResult is what writeMerged wrote.
+type mergeResult struct {
+	moved []movedRecord
+	hints []hintEntry
+	size  int64
+	// pinned counts the bytes that stay dead however often the segment
+	// is merged: its header and the tombstones that had to be kept.
+	pinned int64
+	// skipped counts the corrupt records left out.
+	skipped int
+}
+
+// startMerge runs Compact in the background unless a merge started this
+// way is still running.
+func (db *Db) startMerge() {
+	if !db.merging.CompareAndSwap(false, true) {
+		return
+	}
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+		defer db.merging.Store(false)
+		_ = db.Compact()
+	}()
+}
+
+// MergeSegments compacts all sealed segments into one, keeping only the
+// records the index still points to. The current segment is left alone,
+// so Put and Get keep working while the merge runs; only publishing the
+// result briefly takes the index lock. The records are written again with
+// the current encryption key, which is how old keys are rotated out.
+func (db *Db) MergeSegments() error {
+	if db.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	// Merges leave the current segment alone, so to finish a key rotation
+	// it is sealed if it may still hold records under a previous key.
+	if db.staleCurrent.Load() {
+		if err := db.submit(entryWithAck{seal: true}); err != nil {
+			return err
+		}
+	}
+	db.mergeMutex.Lock()
+	defer db.mergeMutex.Unlock()
+
+	sealed := db.sealedIDs()
+	if len(sealed) == 0 {
+		return nil
+	}
+	return db.mergeRun(sealed, true)
+}
+
+// sealedIDs lists the sealed segments that may be merged in ascending
+// order, leaving out those kept for Options.LogRetention. Segments retired
+// by an earlier merge may still be on disk for snapshots, so they are
+// taken from the Db, not the directory.
+func (db *Db) sealedIDs() []int {
+	limit := -1
+	if db.opts.LogRetention != nil {
+		if from, ok := db.opts.LogRetention(); ok {
+			limit = from.Segment
+		}
+	}
+	var sealed []int
+	db.indexMutex.RLock()
+	if limit < 0 || limit > db.currentID {
+		limit = db.currentID
+	}
+	for id := range db.segments {
+		if id < limit {
+			sealed = append(sealed, id)
+		}
+	}
+	db.indexMutex.RUnlock()
+	sort.Ints(sealed)
+	return sealed
+}
+
+// mergeRun merges a run of sealed segments, adjacent in the order they are
+// replayed, into one. oldest tells whether the run starts with the oldest
+// segment of the Db; otherwise older segments may still hold records of
+// the keys the run deletes. It runs under mergeMutex.
+func (db *Db) mergeRun(run []int, oldest bool) error {
+	start := time.Now()
+
+	// The result takes the place of the oldest segment of the run, so it
+	// is still replayed after the segments before the run and before
+	// every one after it. The run holds the latest record of every key it
+	// keeps, so nothing after it is overtaken.
+	targetID := run[0]
+	tmpPath := filepath.Join(db.dir, "merged.tmp")
+	res, err := db.writeMerged(tmpPath, targetID, run, oldest)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	merged, err := openSegment(targetID, tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	db.indexMutex.Lock()
+	for _, id := range run {
+		os.Remove(db.hintPath(id))
+	}
+	if err := os.Rename(tmpPath, db.segmentPath(targetID)); err != nil {
+		db.indexMutex.Unlock()
+		merged.release()
+		os.Remove(tmpPath)
+		return err
+	}
+	merged.path = db.segmentPath(targetID)
+	// Snapshots keep reading the replaced file through their handles.
+	db.segments[targetID].release()
+	db.segments[targetID] = merged
+	// The merged segments are left, so the index is changed directly and
+	// the space of the result is counted from scratch.
+	space := segmentSpace{size: res.size, pinned: res.pinned}
+	for _, m := range res.moved {
+		// Keys written while the merge was running already point to the
+		// current segment and must keep doing so.
+		if loc, _ := db.index.get(m.key); loc != m.from {
+			continue
+		}
+		if m.expired {
+			db.index.remove(m.key)
+			db.cache.remove(m.key)
+		} else {
+			db.index.set(m.key, m.to)
+			space.live += int64(m.to.size)
+		}
+	}
+	if res.skipped > 0 {
+		db.dropLost(run, res.moved)
+	}
+	for _, id := range run {
+		delete(db.space, id)
+	}
+	db.space[targetID] = space
+	// Old segments are renamed away oldest first and removed once no
+	// snapshot uses them. A crash in between leaves a suffix of them next
+	// to the merged one, and replaying that suffix after it still gives
+	// the latest value of every key.
+	for _, id := range run[1:] {
+		s := db.segments[id]
+		delete(db.segments, id)
+		if err := os.Rename(s.path, db.retiredPath(id)); err == nil {
+			s.path = db.retiredPath(id)
+		}
+		s.retired = true
+		s.release()
+	}
+	db.indexMutex.Unlock()
+
+	_ = writeHintFile(db.hintPath(targetID), db.opts.FileMode, db.cipher, res.size, res.hints)
+	took := time.Since(start)
+	db.merges.Add(1)
+	db.mergeNanos.Add(int64(took))
+	db.lastMergeNanos.Store(int64(took))
+	return nil
+}
+
+// dropLost removes the keys that still point into the merged segments
+// without having been moved: their records were skipped as corrupt, so
+// nothing is left for them to point to. It runs under the index lock.
+func (db *Db) dropLost(sealed []int, moved []movedRecord) {
+	merged := make(map[int]bool, len(sealed))
+	for _, id := range sealed {
+		merged[id] = true
+	}
+	movedTo := make(map[string]recordLocation, len(moved))
+	for _, m := range moved {
+		movedTo[m.key] = m.to
+	}
+	var lost []string
+	db.index.ascend("", func(key string, loc recordLocation) bool {
+		if to, ok := movedTo[key]; merged[loc.segmentID] && (!ok || loc != to) {
+			lost = append(lost, key)
+		}
+		return true
+	})
+	for _, key := range lost {
+		db.index.remove(key)
+		db.cache.remove(key)
+	}
+}
+
+// writeMerged copies the live records of a run of segments into a new
+// file at path. If the run starts with the oldest segment, tombstones and
+// expired records are dropped, as there is nothing older left that would
+// come back without them. Otherwise every key of the run that is deleted
+// or expired gets a tombstone instead. If the last record is dropped, a
+// marker takes its place, so that Open still finds the latest sequence
+// number.
+func (db *Db) writeMerged(path string, targetID int, run []int, oldest bool) (mergeResult, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, db.opts.FileMode)
+	if err != nil {
+		return mergeResult{}, err
+	}
+	defer f.Close()
+	writer := bufio.NewWriter(f)
+	header := newSegmentHeader()
+	header.flags |= segmentRewritten
+	if _, err := writer.Write(header.encode()); err != nil {
+		return mergeResult{}, err
+	}
+
+	var moved []movedRecord
+	var hints []hintEntry
+	offset := int64(segmentHeaderSize)
+	pinned := int64(segmentHeaderSize)
+	skipped := 0
+	var last entry
+	var lastKept bool
+	deleted := make(map[string]bool)
+	now := time.Now()
+	for _, id := range run {
+		n, err := db.scanSegment(id, false, func(e entry, loc recordLocation) error {
+			last, lastKept = e, false
+			db.indexMutex.RLock()
+			current, indexed := db.index.get(e.key)
+			live := current == loc
+			db.indexMutex.RUnlock()
+			if !live && (oldest || indexed) {
+				return nil
+			}
+			if loc.expired(now) || !live {
+				if live {
+					moved = append(moved, movedRecord{key: e.key, from: loc, expired: true})
+				}
+				if oldest || deleted[e.key] {
+					return nil
+				}
+				// Older segments may still hold the key, so a tombstone
+				// keeps it deleted. One is enough for all its records.
+				deleted[e.key] = true
+				lastKept = true
+				tombstone := entry{key: e.key, flags: flagTombstone, seq: e.seq}
+				data := db.cipher.encode(tombstone)
+				if _, err := writer.Write(data); err != nil {
+					return err
+				}
+				hints = append(hints, newHintEntry(tombstone, recordLocation{segmentID: targetID, offset: offset, size: len(data)}))
+				offset += int64(len(data))
+				pinned += int64(len(data))
+				return nil
+			}
+
+			lastKept = true
+			var size int
+			var err error
+			if e.detached {
+				size, err = db.copyDetached(writer, e, loc)
+			} else {
+				size, err = writer.Write(db.cipher.encode(e))
+			}
+			if err != nil {
+				return err
+			}
+			to := recordLocation{
+				segmentID: targetID,
+				offset:    offset,
+				size:      size,
+				version:   e.version,
+				expiresAt: e.expiresAt,
+			}
+			moved = append(moved, movedRecord{key: e.key, from: loc, to: to})
+			hints = append(hints, newHintEntry(e, to))
+			offset += int64(size)
+			return nil
+		})
+		if err != nil {
+			return mergeResult{}, err
+		}
+		skipped += n
+	}
+	if !lastKept && last.seq != 0 {
+		mark := entry{flags: flagSeqMark, seq: last.seq}
+		data := db.cipher.encode(mark)
+		if _, err := writer.Write(data); err != nil {
+			return mergeResult{}, err
+		}
+		hints = append(hints, newHintEntry(mark, recordLocation{segmentID: targetID, offset: offset, size: len(data)}))
+		offset += int64(len(data))
+		pinned += int64(len(data))
+	}
+
+	if err := writer.Flush(); err != nil {
+		return mergeResult{}, err
+	}
+	if err := f.Sync(); err != nil {
+		return mergeResult{}, err
+	}
+	return mergeResult{moved: moved, hints: hints, size: offset, pinned: pinned, skipped: skipped}, f.Close()
+}
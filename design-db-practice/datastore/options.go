@@ -0,0 +1,131 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+)
+
+// Options configure a database instance. Zero fields take the value from
+// DefaultOptions.
+type Options struct {
+	// SegmentSize is the size in bytes after which the current segment is
+	// sealed and a new one is started.
+	SegmentSize int64
+	// MergeThreshold is the number of segment files above which sealed
+	// segments are merged in the background. It is only used by the
+	// default compaction policy.
+	MergeThreshold int
+	// LogRetention, if set, returns the log position from which readers
+	// of the log may still need the segments, for example the oldest
+	// position of the followers of a leader, and whether there is one.
+	// Merges leave the segments from there on alone, so that the log can
+	// still be read from the position.
+	LogRetention func() (LogPosition, bool)
+	// Compaction selects the sealed segments merged in the background.
+	// It is asked whenever a segment is sealed and once a minute. The
+	// default is a SegmentCountPolicy with MergeThreshold.
+	Compaction CompactionPolicy
+	// WriteQueueSize is how many writes can wait for the write loop before
+	// Put blocks.
+	WriteQueueSize int
+	// FileMode is the permission of the files created in the directory.
+	FileMode os.FileMode
+	// Sync is the durability policy of writes.
+	Sync SyncPolicy
+	// OrderedIndex keeps keys sorted in memory, which makes Scan and
+	// ScanPrefix proportional to the keys they return instead of to all
+	// keys, at the cost of slower lookups.
+	OrderedIndex bool
+	// WatchHistory is how many recent changes are kept in memory, so that
+	// a watcher can resume from a sequence number that far back.
+	WatchHistory int
+	// CacheSize is the memory in bytes given to an LRU cache of recently
+	// read values. Zero disables the cache.
+	CacheSize int64
+	// CompressionThreshold is the value size in bytes from which values
+	// are stored deflated, if that makes them smaller. Zero disables
+	// compression. Reads handle compressed records either way.
+	CompressionThreshold int
+	// EncryptionKey, if set, encrypts every record written with AES-GCM.
+	// It must be 16, 24 or 32 bytes long. Records written before it was
+	// set stay readable and are encrypted when merged.
+	EncryptionKey []byte
+	// PreviousKeys are keys that records may still be encrypted with.
+	// They are only used for reading, and every merge re-encrypts the
+	// records it keeps with EncryptionKey, so a key can be dropped once
+	// every segment written with it was merged. MergeSegments seals the
+	// current segment first if it holds records from before Open, so a
+	// key can always be dropped after it.
+	PreviousKeys [][]byte
+	// OnCorruption chooses what happens to corrupt records found while
+	// segments are loaded or merged.
+	OnCorruption CorruptionPolicy
+	// ReadOnly opens the database for reading only. The directory is
+	// locked shared, so other read-only Dbs can use it but no writable
+	// one, and nothing in it is changed: writes, merges and backups fail
+	// with ErrReadOnly, and segments that need an upgrade fail Open.
+	ReadOnly bool
+}
+
+// DefaultOptions returns the options used by Open.
+func DefaultOptions() Options {
+	return Options{
+		SegmentSize:    10 * 1024 * 1024,
+		MergeThreshold: 3,
+		WriteQueueSize: 100,
+		FileMode:       0o600,
+		Sync:           SyncPolicy{Mode: SyncNever},
+		WatchHistory:   1024,
+	}
+}
+
+func (o Options) withDefaults() Options {
+	def := DefaultOptions()
+	if o.SegmentSize == 0 {
+		o.SegmentSize = def.SegmentSize
+	}
+	if o.MergeThreshold == 0 {
+		o.MergeThreshold = def.MergeThreshold
+	}
+	if o.Compaction == nil {
+		o.Compaction = SegmentCountPolicy{Threshold: o.MergeThreshold}
+	}
+	if o.WriteQueueSize == 0 {
+		o.WriteQueueSize = def.WriteQueueSize
+	}
+	if o.FileMode == 0 {
+		o.FileMode = def.FileMode
+	}
+	if o.WatchHistory == 0 {
+		o.WatchHistory = def.WatchHistory
+	}
+	return o
+}
+
+func (o Options) validate() error {
+	if o.SegmentSize < 0 {
+		return fmt.Errorf("segment size must be positive, got %d", o.SegmentSize)
+	}
+	if o.MergeThreshold < 0 {
+		return fmt.Errorf("merge threshold must be positive, got %d", o.MergeThreshold)
+	}
+	if o.WriteQueueSize < 0 {
+		return fmt.Errorf("write queue size must be positive, got %d", o.WriteQueueSize)
+	}
+	if o.CompressionThreshold < 0 {
+		return fmt.Errorf("compression threshold must be positive, got %d", o.CompressionThreshold)
+	}
+	if o.CacheSize < 0 {
+		return fmt.Errorf("cache size must be positive, got %d", o.CacheSize)
+	}
+	if o.WatchHistory < 0 {
+		return fmt.Errorf("watch history must be positive, got %d", o.WatchHistory)
+	}
+	if o.OnCorruption != CorruptionFail && o.OnCorruption != CorruptionSkip {
+		return fmt.Errorf("unknown corruption policy %d", o.OnCorruption)
+	}
+	if o.Sync.Mode == SyncInterval && o.Sync.Interval <= 0 {
+		return fmt.Errorf("sync interval must be positive, got %v", o.Sync.Interval)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenWithOptions(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithOptions(tmp, Options{FileMode: 0o640, WriteQueueSize: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if db.opts.SegmentSize != DefaultOptions().SegmentSize {
+		t.Errorf("zero segment size was not defaulted, got %d", db.opts.SegmentSize)
+	}
+	if cap(db.putChan) != 5 {
+		t.Errorf("write queue size = %d, want 5", cap(db.putChan))
+	}
+	info, err := os.Stat(filepath.Join(tmp, fmt.Sprintf(segmentFileFormat, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o640 {
+		t.Errorf("segment file mode = %v, want %v", info.Mode().Perm(), os.FileMode(0o640))
+	}
+}
+
+func TestOpenWithInvalidOptions(t *testing.T) {
+	invalid := []Options{
+		{SegmentSize: -1},
+		{MergeThreshold: -1},
+		{WriteQueueSize: -1},
+		{WatchHistory: -1},
+		{CacheSize: -1},
+		{CompressionThreshold: -1},
+		{OnCorruption: -1},
+		{EncryptionKey: []byte("short")},
+		{PreviousKeys: [][]byte{make([]byte, 20)}},
+		{Sync: SyncPolicy{Mode: SyncInterval}},
+	}
+	for _, opts := range invalid {
+		if db, err := OpenWithOptions(t.TempDir(), opts); err == nil {
+			db.Close()
+			t.Errorf("OpenWithOptions(%+v) succeeded", opts)
+		}
+	}
+}
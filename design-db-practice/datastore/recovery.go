@@ -0,0 +1,141 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// CorruptRecordError reports a record that could not be read back from a
+// segment file.
+type CorruptRecordError struct {
+	SegmentID int
+	Offset    int64
+	Err       error
+}
+
+func (e *CorruptRecordError) Error() string {
+	return fmt.Sprintf("corrupt record in segment %d at offset %d: %v", e.SegmentID, e.Offset, e.Err)
+}
+
+func (e *CorruptRecordError) Unwrap() error {
+	return e.Err
+}
+
+// CorruptionPolicy selects what Open and MergeSegments do with records
+// that cannot be decoded or fail their checksum.
+type CorruptionPolicy int
+
+const (
+	// CorruptionFail stops Open or MergeSegments with a
+	// *CorruptRecordError. A torn end of the newest segment is repaired
+	// anyway, see RecoveryReport.
+	CorruptionFail CorruptionPolicy = iota
+	// CorruptionSkip leaves corrupt records out, as if they were never
+	// written, and lists them in Db.SkippedRecords. An older value of a
+	// key can come back that way.
+	CorruptionSkip
+)
+
+// RecoveryReport describes the repair done by Open when the newest segment
+// ended with a partial or corrupt record, usually left by a crash in the
+// middle of a write. A read-only Db does not change the segment and only
+// ignores its end.
+type RecoveryReport struct {
+	SegmentID int
+	// Offset is the new size of the segment: everything from the broken
+	// record onwards was cut off.
+	Offset int64
+	// DroppedBytes is how much was cut off.
+	DroppedBytes int64
+	// Cause is the error the broken record was detected with.
+	Cause error
+}
+
+func (r *RecoveryReport) String() string {
+	return fmt.Sprintf("segment %d truncated to %d bytes, dropped %d bytes: %v", r.SegmentID, r.Offset, r.DroppedBytes, r.Cause)
+}
+
+// Recovery returns the repair done while opening the database, or nil if
+// every segment was intact.
+func (db *Db) Recovery() *RecoveryReport {
+	return db.recovery
+}
+
+// tornTail tells whether a corrupt record of the newest segment is what a
+// crash in the middle of a write leaves behind: its size runs past the end
+// of the file, or none of the records after it decodes. A corrupt record
+// followed by good ones was damaged after it was written, and cutting it
+// off would lose the good ones too.
+func (db *Db) tornTail(corrupt *CorruptRecordError) (bool, error) {
+	f, err := os.Open(db.segmentPath(corrupt.SegmentID))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	offset := corrupt.Offset
+	first := true
+	for offset < info.Size() {
+		var sizeBuf [4]byte
+		if _, err := f.ReadAt(sizeBuf[:], offset); err != nil {
+			return true, nil
+		}
+		size := int64(binary.LittleEndian.Uint32(sizeBuf[:]))
+		if size < entryFixedSize || size > info.Size()-offset {
+			// Without a size the records after it cannot be found.
+			return true, nil
+		}
+		if !first {
+			var e entry
+			reader := bufio.NewReader(io.NewSectionReader(f, offset, size))
+			if _, err := e.DecodeFromReader(reader); err == nil {
+				return false, nil
+			}
+		}
+		first = false
+		offset += size
+	}
+	return true, nil
+}
+
+// repairTail truncates the newest segment back to the last good record.
+func (db *Db) repairTail(corrupt *CorruptRecordError) error {
+	path := db.segmentPath(corrupt.SegmentID)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Truncate(path, corrupt.Offset); err != nil {
+		return fmt.Errorf("cannot repair segment %d: %w", corrupt.SegmentID, err)
+	}
+	db.recovery = &RecoveryReport{
+		SegmentID:    corrupt.SegmentID,
+		Offset:       corrupt.Offset,
+		DroppedBytes: info.Size() - corrupt.Offset,
+		Cause:        corrupt.Err,
+	}
+	return nil
+}
+
+func (db *Db) skipCorrupt(corrupt *CorruptRecordError) {
+	db.skippedMutex.Lock()
+	db.skipped = append(db.skipped, corrupt)
+	db.skippedMutex.Unlock()
+}
+
+// SkippedRecords returns the corrupt records that Open and merges left out
+// under CorruptionSkip, in the order they were found. A record skipped by
+// Open is found again by the merge that removes it from the disk.
+func (db *Db) SkippedRecords() []*CorruptRecordError {
+	db.skippedMutex.Lock()
+	defer db.skippedMutex.Unlock()
+	return slices.Clone(db.skipped)
+}
@@ -0,0 +1,268 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOpenRepairsTornTail(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k1", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k2", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(tmp, fmt.Sprintf(segmentFileFormat, 0))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	goodSize := info.Size()
+
+	tests := map[string][]byte{
+		"partial size": {1, 2},
+		"partial record": func() []byte {
+			e := entry{key: "k3", value: "v3"}
+			return e.Encode()[:10]
+		}(),
+		"hash mismatch": func() []byte {
+			e := entry{key: "k3", value: "v3"}
+			data := e.Encode()
+			data[len(data)-1] ^= 0xff
+			return data
+		}(),
+	}
+	for name, tail := range tests {
+		t.Run(name, func(t *testing.T) {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write(tail); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			db, err := Open(tmp)
+			if err != nil {
+				t.Fatalf("Open failed on a torn tail: %v", err)
+			}
+			defer db.Close()
+
+			report := db.Recovery()
+			if report == nil {
+				t.Fatal("no recovery report")
+			}
+			if report.Offset != goodSize || report.DroppedBytes != int64(len(tail)) {
+				t.Errorf("report = %s, want truncation to %d dropping %d bytes", report, goodSize, len(tail))
+			}
+			if info, _ := os.Stat(path); info.Size() != goodSize {
+				t.Errorf("segment size = %d, want %d", info.Size(), goodSize)
+			}
+			for _, key := range []string{"k1", "k2"} {
+				if _, err := db.Get(key); err != nil {
+					t.Errorf("Get(%s) after repair: %v", key, err)
+				}
+			}
+			if _, err := db.Get("k3"); err != ErrNotFound {
+				t.Errorf("Get(k3) = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestOpenFailsOnCorruptSealedSegment(t *testing.T) {
+	tmp := t.TempDir()
+
+	opts := Options{SegmentSize: 20}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if err := db.Put(k, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(tmp, fmt.Sprintf(segmentFileFormat, 0))
+	os.Remove(filepath.Join(tmp, fmt.Sprintf(hintFileFormat, 0)))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+
+	if db, err := OpenWithOptions(tmp, opts); err == nil {
+		db.Close()
+		t.Fatal("Open accepted a corrupt sealed segment")
+	}
+}
+
+func TestOpenFailsOnCorruptRecordBeforeGoodOnes(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if err := db.Put(k, "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A flipped byte in the value of a, which b and c follow intact.
+	path := filepath.Join(tmp, fmt.Sprintf(segmentFileFormat, 0))
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{'V'}, segmentHeaderSize+12+1); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []Options{{}, {ReadOnly: true}} {
+		db, err := OpenWithOptions(tmp, opts)
+		var corrupt *CorruptRecordError
+		if !errors.As(err, &corrupt) || corrupt.Offset != segmentHeaderSize {
+			if err == nil {
+				db.Close()
+			}
+			t.Errorf("Open with %+v = %v, want a corrupt record at %d", opts, err, segmentHeaderSize)
+		}
+	}
+	if info, _ := os.Stat(path); info.Size() != before.Size() {
+		t.Errorf("segment size = %d, want %d", info.Size(), before.Size())
+	}
+}
+
+func TestCorruptionPolicy(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 60, MergeThreshold: 100}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c", "d"} {
+		if err := db.Put(k, "value-"+k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Damage the value of b in a sealed segment and find out where it is.
+	var path string
+	var offset int64
+	for _, id := range []int{0, 1, 2} {
+		p := filepath.Join(tmp, fmt.Sprintf(segmentFileFormat, id))
+		data, err := os.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i := strings.Index(string(data), "value-b"); i >= 0 {
+			data[i] ^= 0xff
+			if err := os.WriteFile(p, data, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			path, offset = p, int64(strings.LastIndex(string(data[:i]), "\x01\x00\x00\x00b")-4)
+			os.Remove(filepath.Join(tmp, fmt.Sprintf(hintFileFormat, id)))
+			break
+		}
+	}
+	if path == "" {
+		t.Fatal("value of b not found")
+	}
+
+	var corrupt *CorruptRecordError
+	if _, err := OpenWithOptions(tmp, opts); !errors.As(err, &corrupt) || corrupt.Offset != offset {
+		t.Fatalf("Open = %v, want a corrupt record at offset %d", err, offset)
+	}
+
+	opts.OnCorruption = CorruptionSkip
+	db, err = OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	skipped := db.SkippedRecords()
+	if len(skipped) != 1 || skipped[0].Offset != offset || !errors.Is(skipped[0], errChecksumMismatch) {
+		t.Errorf("skipped records = %v, want one at offset %d", skipped, offset)
+	}
+	if _, err := db.Get("b"); err != ErrNotFound {
+		t.Errorf("Get of a skipped key = %v, want ErrNotFound", err)
+	}
+	for _, k := range []string{"a", "c", "d"} {
+		if value, err := db.Get(k); err != nil || value != "value-"+k {
+			t.Errorf("Get(%s) = %q, %v", k, value, err)
+		}
+	}
+
+	t.Run("merge", func(t *testing.T) {
+		// The record of c was loaded fine and gets damaged afterwards, so
+		// only the merge runs into it.
+		path := filepath.Join(tmp, fmt.Sprintf(segmentFileFormat, 2))
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i := strings.Index(string(data), "value-c")
+		if i < 0 {
+			t.Fatal("value of c not found")
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.WriteAt([]byte{data[i] ^ 0xff}, int64(i))
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.MergeSegments(); err != nil {
+			t.Fatal(err)
+		}
+		// The merge runs into the record of b again.
+		skipped := db.SkippedRecords()
+		if len(skipped) != 3 || skipped[2].SegmentID != 2 {
+			t.Errorf("skipped records after merge = %v", skipped)
+		}
+		if _, err := db.Get("c"); err != ErrNotFound {
+			t.Errorf("Get of a key lost in the merge = %v, want ErrNotFound", err)
+		}
+		for _, k := range []string{"a", "d"} {
+			if value, err := db.Get(k); err != nil || value != "value-"+k {
+				t.Errorf("Get(%s) = %q, %v", k, value, err)
+			}
+		}
+	})
+}
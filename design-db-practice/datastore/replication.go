@@ -0,0 +1,305 @@
+package datastore
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// ErrLogUnavailable is returned for a LogPosition the Db cannot read from
+// anymore, usually because a merge rewrote the segment it points into. A
+// replica at such a position has to start over from a backup;
+// Options.LogRetention keeps merges away from positions still in use.
+var ErrLogUnavailable = errors.New("log position is no longer available")
+
+// LogPosition is a place in the write log of a Db: an offset in one of its
+// segments. Positions only grow as records are written.
+type LogPosition struct {
+	Segment int   `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+// Compare returns -1, 0 or +1 depending on whether p is before, at or
+// after q.
+func (p LogPosition) Compare(q LogPosition) int {
+	if c := cmp.Compare(p.Segment, q.Segment); c != 0 {
+		return c
+	}
+	return cmp.Compare(p.Offset, q.Offset)
+}
+
+func (p LogPosition) String() string {
+	return fmt.Sprintf("%d:%d", p.Segment, p.Offset)
+}
+
+// ParseLogPosition parses the form produced by LogPosition.String.
+func ParseLogPosition(s string) (LogPosition, error) {
+	var p LogPosition
+	if _, err := fmt.Sscanf(s, "%d:%d", &p.Segment, &p.Offset); err != nil {
+		return LogPosition{}, fmt.Errorf("bad log position %q", s)
+	}
+	if p.String() != s || p.Segment < 0 || p.Offset < 0 {
+		return LogPosition{}, fmt.Errorf("bad log position %q", s)
+	}
+	return p, nil
+}
+
+// LogEnd returns the position right after the last write.
+func (db *Db) LogEnd() LogPosition {
+	db.indexMutex.RLock()
+	defer db.indexMutex.RUnlock()
+	return LogPosition{Segment: db.currentID, Offset: db.currentOffset}
+}
+
+// notifyLog wakes up the log readers waiting for a write. The caller must
+// hold indexMutex for writing.
+func (db *Db) notifyLog() {
+	close(db.logSignal)
+	db.logSignal = make(chan struct{})
+}
+
+// LogReader returns the records of a Db in the order they were written,
+// exactly as they are stored. It keeps the segment it reads from open, so
+// a merge running meanwhile does not disturb it.
+type LogReader struct {
+	db  *Db
+	seg *segment
+	pos LogPosition
+}
+
+// OpenLog returns a reader of the records written from the position on.
+// The reader must be closed.
+func (db *Db) OpenLog(from LogPosition) (*LogReader, error) {
+	db.indexMutex.RLock()
+	defer db.indexMutex.RUnlock()
+	if db.segments == nil {
+		return nil, errClosed
+	}
+	end := LogPosition{Segment: db.currentID, Offset: db.currentOffset}
+	// The start of a segment is where its first record is.
+	from.Offset = max(from.Offset, segmentHeaderSize)
+	s, ok := db.segments[from.Segment]
+	if !ok || !s.logged || from.Compare(end) > 0 {
+		return nil, ErrLogUnavailable
+	}
+	s.acquire()
+	return &LogReader{db: db, seg: s, pos: from}, nil
+}
+
+// Position returns the position of the next record.
+func (r *LogReader) Position() LogPosition {
+	return r.pos
+}
+
+// Next returns the next record, or io.EOF if the reader has caught up
+// with the last write.
+func (r *LogReader) Next() ([]byte, error) {
+	rec, size, err := r.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, size)
+	if _, err := io.ReadFull(rec, record); err != nil {
+		return nil, &CorruptRecordError{SegmentID: r.pos.Segment, Offset: r.pos.Offset - size, Err: err}
+	}
+	return record, nil
+}
+
+// NextReader is Next for records that should not be held in memory: it
+// returns a reader of the next record and its size. The reader reads
+// from the segment and is only valid until the next call or Close.
+func (r *LogReader) NextReader() (io.Reader, int64, error) {
+	end, err := r.readable()
+	if err != nil {
+		return nil, 0, err
+	}
+	if r.pos.Offset == end {
+		return nil, 0, io.EOF
+	}
+
+	var sizeBuf [4]byte
+	if _, err := r.seg.file.ReadAt(sizeBuf[:], r.pos.Offset); err != nil {
+		return nil, 0, r.corrupt(err)
+	}
+	size := int64(binary.LittleEndian.Uint32(sizeBuf[:]))
+	if size < entryFixedSize || size > end-r.pos.Offset {
+		return nil, 0, r.corrupt(fmt.Errorf("record size %d does not fit the segment", size))
+	}
+	rec := io.NewSectionReader(r.seg.file, r.pos.Offset, size)
+	r.pos.Offset += size
+	return rec, size, nil
+}
+
+func (r *LogReader) corrupt(err error) error {
+	return &CorruptRecordError{SegmentID: r.pos.Segment, Offset: r.pos.Offset, Err: err}
+}
+
+// readable returns how far the segment of the reader can be read. A
+// sealed segment read to its end is swapped for the next one.
+func (r *LogReader) readable() (int64, error) {
+	db := r.db
+	db.indexMutex.RLock()
+	defer db.indexMutex.RUnlock()
+	if db.segments == nil {
+		return 0, errClosed
+	}
+	for {
+		if r.pos.Segment == db.currentID {
+			return db.currentOffset, nil
+		}
+		// Sealed segments do not change anymore. The reader holds the file
+		// it started with even if a merge replaced it since.
+		info, err := r.seg.file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		if r.pos.Offset > info.Size() {
+			return 0, ErrLogUnavailable
+		}
+		if r.pos.Offset < info.Size() {
+			return info.Size(), nil
+		}
+		next, ok := db.segments[r.pos.Segment+1]
+		if !ok || !next.logged {
+			return 0, ErrLogUnavailable
+		}
+		next.acquire()
+		r.seg.release()
+		r.seg = next
+		r.pos = LogPosition{Segment: next.id, Offset: segmentHeaderSize}
+	}
+}
+
+// Wait blocks until a record is written after the position of the reader,
+// ctx is done or the Db is closed.
+func (r *LogReader) Wait(ctx context.Context) error {
+	db := r.db
+	db.indexMutex.RLock()
+	behind := r.pos.Segment != db.currentID || r.pos.Offset < db.currentOffset
+	signal := db.logSignal
+	db.indexMutex.RUnlock()
+	if behind {
+		return nil
+	}
+
+	select {
+	case <-signal:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-db.closeChan:
+		return errClosed
+	}
+}
+
+// Close releases the segment the reader holds.
+func (r *LogReader) Close() {
+	if r.seg != nil {
+		r.seg.release()
+		r.seg = nil
+	}
+}
+
+// Apply appends a record read from the log of another Db with a
+// LogReader. The record keeps the version and expiry time it was written
+// with, and no condition is checked, so a Db that records are applied to
+// must not take writes of its own.
+func (db *Db) Apply(record []byte) error {
+	var e entry
+	if len(record) < 4 || int(binary.LittleEndian.Uint32(record)) != len(record) {
+		return fmt.Errorf("apply: record size does not match its header")
+	}
+	if err := e.Decode(record); err != nil {
+		return fmt.Errorf("apply: %w", err)
+	}
+	// The record is stored encrypted the way this Db encrypts, so the
+	// leader and the follower may use different keys as long as the
+	// follower knows the ones of the leader.
+	e, err := db.cipher.decrypt(e)
+	if err != nil {
+		return fmt.Errorf("apply: %w", err)
+	}
+	if e.isBatch() {
+		var value strings.Builder
+		err := expandRecord(db.cipher, e, recordLocation{}, func(inner entry, _ recordLocation) error {
+			value.Write(db.cipher.encode(inner))
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("apply: %w", err)
+		}
+		e.value = value.String()
+	}
+	return db.submit(entryWithAck{entry: e, replicated: true})
+}
+
+// ApplyStream is Apply for a record read from r, which has size bytes.
+// A large record is staged on disk and its value copied from there, so it
+// is not held in memory, unless it has to be decrypted or encrypted,
+// which needs all of it.
+func (db *Db) ApplyStream(r io.Reader, size int64) error {
+	if size < largeRecordSize {
+		record := make([]byte, size)
+		if _, err := io.ReadFull(r, record); err != nil {
+			return fmt.Errorf("apply: %w", err)
+		}
+		return db.Apply(record)
+	}
+	if size > math.MaxUint32 {
+		return fmt.Errorf("apply: record of %d bytes is too large", size)
+	}
+
+	f, err := os.CreateTemp(db.dir, streamFilePattern)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	if _, err := copyStream(bufio.NewWriter(f), r, size); err != nil {
+		return fmt.Errorf("apply: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var sizeBuf [4]byte
+	if _, err := io.ReadFull(f, sizeBuf[:]); err != nil {
+		return err
+	}
+	if int64(binary.LittleEndian.Uint32(sizeBuf[:])) != size {
+		return fmt.Errorf("apply: record size does not match its header")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var e entry
+	if _, err := e.decodeDetached(bufio.NewReader(f), size); err != nil {
+		return fmt.Errorf("apply: %w", err)
+	}
+	if e.isBatch() || e.flags&flagEncrypted != 0 || db.cipher.encrypts() {
+		record := make([]byte, size)
+		if _, err := f.ReadAt(record, 0); err != nil {
+			return err
+		}
+		return db.Apply(record)
+	}
+
+	// The value follows the size, the key length, the key and its length.
+	valueOffset := 12 + int64(len(e.key))
+	if _, err := f.ReadAt(sizeBuf[:], valueOffset-4); err != nil {
+		return err
+	}
+	if _, err := f.Seek(valueOffset, io.SeekStart); err != nil {
+		return err
+	}
+	vl := int64(binary.LittleEndian.Uint32(sizeBuf[:]))
+	return db.submit(entryWithAck{entry: e, replicated: true, stream: f, streamSize: vl})
+}
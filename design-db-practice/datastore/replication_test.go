@@ -0,0 +1,271 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReplication(t *testing.T) {
+	opts := Options{SegmentSize: 100, MergeThreshold: 100}
+	leader, err := OpenWithOptions(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = leader.Close()
+	})
+
+	for i := 0; i < 5; i++ {
+		if err := leader.Put(fmt.Sprintf("key%d", i), "before"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var archive bytes.Buffer
+	if err := leader.Backup(&archive); err != nil {
+		t.Fatal(err)
+	}
+	followerDir := t.TempDir()
+	pos, err := RestoreReplica(&archive, followerDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	follower, err := OpenWithOptions(followerDir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = follower.Close()
+	})
+
+	for i := 0; i < 5; i++ {
+		if err := leader.Put(fmt.Sprintf("key%d", i), "after"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := leader.Delete("key0"); err != nil {
+		t.Fatal(err)
+	}
+	var batch WriteBatch
+	batch.Put("batched", "value")
+	batch.Delete("key1")
+	if err := leader.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := leader.OpenLog(pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for {
+		record, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := follower.Apply(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.Position() != leader.LogEnd() {
+		t.Errorf("reader stopped at %v, log ends at %v", r.Position(), leader.LogEnd())
+	}
+
+	for _, key := range []string{"key0", "key1"} {
+		if _, err := follower.Get(key); err != ErrNotFound {
+			t.Errorf("follower Get(%s) = %v, want ErrNotFound", key, err)
+		}
+	}
+	for i := 2; i < 5; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if value, version, err := follower.GetWithVersion(key); err != nil || value != "after" || version != 2 {
+			t.Errorf("follower Get(%s) = %q, version %d, %v", key, value, version, err)
+		}
+	}
+	if value, err := follower.Get("batched"); err != nil || value != "value" {
+		t.Errorf("follower Get(batched) = %q, %v", value, err)
+	}
+
+	t.Run("wait", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		if err := r.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Wait with nothing to read = %v", err)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- r.Wait(context.Background())
+		}()
+		if err := leader.Put("late", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.Next(); err != nil {
+			t.Errorf("Next after Wait: %v", err)
+		}
+	})
+
+	t.Run("merged position", func(t *testing.T) {
+		if err := leader.MergeSegments(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := leader.OpenLog(pos); !errors.Is(err, ErrLogUnavailable) {
+			t.Errorf("OpenLog in a merged segment = %v, want ErrLogUnavailable", err)
+		}
+		if _, err := leader.OpenLog(LogPosition{Segment: pos.Segment + 100}); !errors.Is(err, ErrLogUnavailable) {
+			t.Errorf("OpenLog past the end = %v, want ErrLogUnavailable", err)
+		}
+	})
+}
+
+func TestLogRetention(t *testing.T) {
+	var retained atomic.Pointer[LogPosition]
+	opts := Options{SegmentSize: 100, MergeThreshold: 100, LogRetention: func() (LogPosition, bool) {
+		pos := retained.Load()
+		if pos == nil {
+			return LogPosition{}, false
+		}
+		return *pos, true
+	}}
+	db, err := OpenWithOptions(t.TempDir(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	put := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(10)
+	// A follower somewhere in the sealed segments.
+	pos := db.LogEnd()
+	retained.Store(&pos)
+	put(10)
+	if db.LogEnd().Segment <= pos.Segment+1 {
+		t.Fatalf("log ends at %v, want sealed segments after %v", db.LogEnd(), pos)
+	}
+
+	if err := db.MergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+	db.indexMutex.RLock()
+	for id := range db.segments {
+		if id > 0 && id < pos.Segment {
+			t.Errorf("segment %d before the retained position was not merged", id)
+		}
+	}
+	db.indexMutex.RUnlock()
+	r, err := db.OpenLog(pos)
+	if err != nil {
+		t.Fatalf("OpenLog at the retained position: %v", err)
+	}
+	defer r.Close()
+	for {
+		if _, err := r.Next(); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.Position() != db.LogEnd() {
+		t.Errorf("reader stopped at %v, log ends at %v", r.Position(), db.LogEnd())
+	}
+
+	retained.Store(nil)
+	if err := db.MergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.OpenLog(pos); !errors.Is(err, ErrLogUnavailable) {
+		t.Errorf("OpenLog after the position was released = %v, want ErrLogUnavailable", err)
+	}
+}
+
+func TestLogAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{SegmentSize: 100, MergeThreshold: 100}
+	db, err := OpenWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	reopen := func() {
+		t.Helper()
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = OpenWithOptions(dir, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Put("first", "value"); err != nil {
+		t.Fatal(err)
+	}
+	// A follower behind by a few sealed segments.
+	pos := db.LogEnd()
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if db.LogEnd().Segment <= pos.Segment+1 {
+		t.Fatalf("log ends at %v, want sealed segments after %v", db.LogEnd(), pos)
+	}
+
+	reopen()
+	r, err := db.OpenLog(pos)
+	if err != nil {
+		t.Fatalf("OpenLog in a sealed segment after reopening: %v", err)
+	}
+	for {
+		if _, err := r.Next(); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.Position() != db.LogEnd() {
+		t.Errorf("reader stopped at %v, log ends at %v", r.Position(), db.LogEnd())
+	}
+	r.Close()
+
+	// The merge result takes the ID of the segment of the position.
+	if err := db.MergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+	reopen()
+	if _, err := db.OpenLog(pos); !errors.Is(err, ErrLogUnavailable) {
+		t.Errorf("OpenLog in a merged segment after reopening = %v, want ErrLogUnavailable", err)
+	}
+}
+
+func TestParseLogPosition(t *testing.T) {
+	p := LogPosition{Segment: 3, Offset: 120}
+	if got, err := ParseLogPosition(p.String()); err != nil || got != p {
+		t.Errorf("ParseLogPosition(%q) = %v, %v", p.String(), got, err)
+	}
+	for _, s := range []string{"", "3", "3:", "-1:0", "3:12x"} {
+		if _, err := ParseLogPosition(s); err == nil {
+			t.Errorf("ParseLogPosition(%q) succeeded", s)
+		}
+	}
+}
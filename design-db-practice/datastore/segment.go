@@ -0,0 +1,153 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// retiredFileFormat names segments retired by a merge that snapshots
+// still read from. Open does not replay them and removes leftovers.
+const retiredFileFormat = "retired-%06d.db"
+
+// segment is a read handle of a segment file, shared by the Db and its
+// snapshots. The Db holds one reference for as long as the segment is in
+// use and every snapshot holds another. When the last reference is
+// released the file is closed and, if a merge retired the segment,
+// removed.
+type segment struct {
+	id   int
+	path string
+	file *os.File
+	refs atomic.Int32
+	// retired is set before the Db drops its reference to a segment
+	// whose records were merged into another one.
+	retired bool
+	// logged is set for segments that hold their records in the order
+	// they were written. A merge result may reuse the ID of a segment, so
+	// LogPositions in segments marked rewritten cannot be trusted.
+	logged bool
+}
+
+// openSegment opens a read handle of the segment file at path, holding
+// one reference for the caller.
+func openSegment(id int, path string) (*segment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &segment{id: id, path: path, file: f}
+	s.refs.Store(1)
+	return s, nil
+}
+
+func (s *segment) acquire() {
+	s.refs.Add(1)
+}
+
+func (s *segment) release() {
+	if s.refs.Add(-1) > 0 {
+		return
+	}
+	s.file.Close()
+	if s.retired {
+		os.Remove(s.path)
+	}
+}
+
+// view is what reads go through: an index and the segments its locations
+// point into.
+type view struct {
+	index    keyIndex
+	segments map[int]*segment
+	// cache is only set for the Db itself; snapshots read past it.
+	cache *valueCache
+	// cipher decrypts the records of encrypted segments.
+	cipher *recordCipher
+	// at freezes the clock used for expiry; zero means time.Now.
+	at time.Time
+}
+
+func (v *view) now() time.Time {
+	if v.at.IsZero() {
+		return time.Now()
+	}
+	return v.at
+}
+
+func (v *view) getItem(key string) (Item, error) {
+	loc, ok := v.index.get(key)
+	if !ok || loc.expired(v.now()) {
+		return Item{}, ErrNotFound
+	}
+	value, ok := v.cache.get(key)
+	if !ok {
+		var err error
+		if value, err = v.readValue(loc); err != nil {
+			return Item{}, err
+		}
+		v.cache.add(key, value)
+	}
+	item := Item{Value: value, Version: loc.version}
+	if loc.expiresAt != 0 {
+		item.ExpiresAt = time.Unix(0, loc.expiresAt)
+	}
+	return item, nil
+}
+
+// maxPooledRecord is the size of the largest record buffer kept for reuse
+// by readValue.
+const maxPooledRecord = 64 * 1024
+
+var recordBuffers = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 4096)
+		return &buf
+	},
+}
+
+// readValue reads the value of the record at loc.
+func (v *view) readValue(loc recordLocation) (string, error) {
+	s, ok := v.segments[loc.segmentID]
+	if !ok {
+		return "", fmt.Errorf("segment %d is not open", loc.segmentID)
+	}
+	var value string
+	err := s.viewValue(loc, v.cipher, func(b []byte) error {
+		value = string(b)
+		return nil
+	})
+	return value, err
+}
+
+// viewValue reads the record at loc with a single positional read and
+// calls fn with its value, which is only valid until fn returns.
+func (s *segment) viewValue(loc recordLocation, c *recordCipher, fn func(value []byte) error) error {
+	bufp := recordBuffers.Get().(*[]byte)
+	buf := *bufp
+	if cap(buf) < loc.size {
+		buf = make([]byte, loc.size)
+	}
+	buf = buf[:loc.size]
+	defer func() {
+		if cap(buf) <= maxPooledRecord {
+			*bufp = buf
+			recordBuffers.Put(bufp)
+		}
+	}()
+
+	if _, err := s.file.ReadAt(buf, loc.offset); err != nil {
+		return fmt.Errorf("cannot read record at %d:%d: %w", loc.segmentID, loc.offset, err)
+	}
+	if int(binary.LittleEndian.Uint32(buf)) != loc.size {
+		return fmt.Errorf("record at %d:%d does not have the indexed size", loc.segmentID, loc.offset)
+	}
+	value, err := decodeValue(buf, c)
+	if err != nil {
+		return err
+	}
+	return fn(value)
+}
@@ -0,0 +1,98 @@
+package datastore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestGetDetectsCorruption(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	if err := db.Put("key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := db.Get("key"); err != nil || value != "value" {
+		t.Fatalf("Get = %q, %v", value, err)
+	}
+
+	path := db.segmentPath(0)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[strings.Index(string(data), "value")] ^= 0xff
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key"); !errors.Is(err, errChecksumMismatch) {
+		t.Errorf("Get of a corrupted record = %v, want errChecksumMismatch", err)
+	}
+}
+
+func benchmarkDb(b *testing.B) (*Db, []string) {
+	db, err := Open(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		_ = db.Close()
+	})
+	keys := make([]string, 1000)
+	value := strings.Repeat("v", 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+		if err := db.Put(keys[i], value); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return db, keys
+}
+
+func BenchmarkGet(b *testing.B) {
+	db, keys := benchmarkDb(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := db.Get(keys[i%len(keys)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkGetOpenPerRead reads like Get did before segment handles were
+// kept open, as a baseline for BenchmarkGet.
+func BenchmarkGetOpenPerRead(b *testing.B) {
+	db, keys := benchmarkDb(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db.indexMutex.RLock()
+		loc, _ := db.index.get(keys[i%len(keys)])
+		db.indexMutex.RUnlock()
+
+		f, err := os.Open(db.segmentPath(loc.segmentID))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := f.Seek(loc.offset, io.SeekStart); err != nil {
+			b.Fatal(err)
+		}
+		var e entry
+		if _, err := e.DecodeFromReader(bufio.NewReader(f)); err != nil {
+			b.Fatal(err)
+		}
+		f.Close()
+	}
+}
@@ -0,0 +1,95 @@
+package datastore
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errReleased = errors.New("snapshot is released")
+
+// Snapshot is a read-only view of a Db as of the moment it was taken.
+// Writes and merges made afterwards are not visible through it, and
+// expiry is evaluated at the time it was taken.
+//
+// A snapshot keeps the segment files it reads from on disk even if a
+// merge replaces them, so it must be released once it is no longer needed.
+type Snapshot struct {
+	view
+	mu       sync.RWMutex
+	released bool
+}
+
+// Snapshot returns a snapshot of the current contents of the database.
+// Taking it copies the index, so it costs time proportional to the number
+// of keys.
+func (db *Db) Snapshot() (*Snapshot, error) {
+	db.indexMutex.RLock()
+	defer db.indexMutex.RUnlock()
+	if db.segments == nil {
+		return nil, errClosed
+	}
+
+	s := &Snapshot{view: view{
+		index:    db.index.clone(),
+		segments: make(map[int]*segment, len(db.segments)),
+		cipher:   db.cipher,
+		at:       time.Now(),
+	}}
+	for id, seg := range db.segments {
+		seg.acquire()
+		s.segments[id] = seg
+	}
+	return s, nil
+}
+
+// Get returns the value of key as of the snapshot.
+func (s *Snapshot) Get(key string) (string, error) {
+	item, err := s.GetItem(key)
+	return item.Value, err
+}
+
+// GetItem returns the value of key as of the snapshot with its metadata.
+func (s *Snapshot) GetItem(key string) (Item, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.released {
+		return Item{}, errReleased
+	}
+	return s.getItem(key)
+}
+
+// Scan returns an iterator over the keys of the snapshot in [start, end).
+// An empty end means no upper bound.
+func (s *Snapshot) Scan(start, end string) *Iterator {
+	return &Iterator{lock: s.mu.RLocker(), v: &s.view, start: start, end: end}
+}
+
+// ScanPrefix returns an iterator over the keys of the snapshot that start
+// with prefix.
+func (s *Snapshot) ScanPrefix(prefix string) *Iterator {
+	return s.Scan(prefix, prefixEnd(prefix))
+}
+
+// Release lets go of the segment files the snapshot uses. Reads made
+// afterwards fail. Release may be called more than once.
+func (s *Snapshot) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released {
+		return
+	}
+	s.released = true
+
+	// Retired segments are removed oldest first, as a merge would.
+	ids := make([]int, 0, len(s.segments))
+	for id := range s.segments {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		s.segments[id].release()
+	}
+	s.segments = nil
+}
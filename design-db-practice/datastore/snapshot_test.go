@@ -0,0 +1,111 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 100, MergeThreshold: 100}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key%d", i), "old"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snap, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if i%2 == 0 {
+			err = db.Delete(key)
+		} else {
+			err = db.Put(key, "new")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("added", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.MergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+	db.indexMutex.RLock()
+	var retired []string
+	for id, s := range snap.segments {
+		if _, ok := db.segments[id]; !ok {
+			retired = append(retired, s.path)
+		}
+	}
+	db.indexMutex.RUnlock()
+	if len(retired) == 0 {
+		t.Fatal("merge retired no segment used by the snapshot")
+	}
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%d", i)
+		if value, err := snap.Get(key); err != nil || value != "old" {
+			t.Errorf("snapshot Get(%s) = %q, %v, want old", key, value, err)
+		}
+	}
+	if _, err := snap.Get("added"); err != ErrNotFound {
+		t.Errorf("snapshot Get(added) = %v, want ErrNotFound", err)
+	}
+	var keys int
+	it := snap.ScanPrefix("key")
+	for it.Next() {
+		keys++
+	}
+	if it.Err() != nil || keys != 10 {
+		t.Errorf("snapshot scan returned %d keys, err %v", keys, it.Err())
+	}
+	if value, err := db.Get("key1"); err != nil || value != "new" {
+		t.Errorf("Get(key1) = %q, %v, want new", value, err)
+	}
+
+	for _, path := range retired {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("segment used by the snapshot was removed: %v", err)
+		}
+	}
+	snap.Release()
+	snap.Release()
+	for _, path := range retired {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("retired segment %s is still there after Release", path)
+		}
+	}
+	if _, err := snap.Get("key1"); err == nil {
+		t.Error("Get on a released snapshot succeeded")
+	}
+
+	// A snapshot outlives the database it was taken from.
+	snap, err = db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Snapshot(); err == nil {
+		t.Error("Snapshot on a closed database succeeded")
+	}
+	if value, err := snap.Get("key1"); err != nil || value != "new" {
+		t.Errorf("Get(key1) after Close = %q, %v, want new", value, err)
+	}
+	snap.Release()
+}
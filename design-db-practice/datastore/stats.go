@@ -0,0 +1,121 @@
+package datastore
+
+import (
+	"sort"
+	"time"
+)
+
+// Stats describes the contents and the activity of a Db.
+type Stats struct {
+	// Keys counts the keys in the index, including expired ones that no
+	// merge has dropped yet.
+	Keys int
+	// Segments describes the segments, oldest first.
+	Segments []SegmentStats
+	// LiveBytes and DeadBytes are the totals of the segments.
+	LiveBytes int64
+	DeadBytes int64
+
+	// Merges counts the merges done since Open. MergeDuration is the time
+	// they took together and LastMergeDuration that of the latest one.
+	Merges            int64
+	MergeDuration     time.Duration
+	LastMergeDuration time.Duration
+
+	// WriteQueue is the number of writes waiting for the write loop.
+	WriteQueue int
+	// Syncs counts the fsyncs of the current segment since Open, and
+	// LastSync is the time of the latest one, zero if there was none.
+	Syncs    int64
+	LastSync time.Time
+
+	Cache CacheStats
+}
+
+// SegmentStats describes the space a segment takes.
+type SegmentStats struct {
+	ID   int
+	Size int64
+	// LiveBytes is taken by the records the index points to. The rest is
+	// dead: overwritten and deleted records, tombstones, the header and
+	// what batches take on top of their records.
+	LiveBytes int64
+	DeadBytes int64
+	// Reclaimable is the part of the dead bytes a merge is expected to
+	// free. It leaves out the header and the tombstones an earlier merge
+	// had to keep.
+	Reclaimable int64
+}
+
+// segmentSpace tracks the size of a segment and how many of its bytes are
+// live. Db keeps it up to date as records are written and merged instead
+// of scanning the index. pinned bytes are dead but stay in the segment
+// when it is merged.
+type segmentSpace struct {
+	size, live, pinned int64
+}
+
+// setLocation points key to loc. The record it pointed to before becomes
+// dead. It runs under the write lock of the index.
+func (db *Db) setLocation(key string, loc recordLocation) {
+	db.removeLocation(key)
+	db.index.set(key, loc)
+	db.addLive(loc.segmentID, int64(loc.size))
+}
+
+// removeLocation removes key from the index. The record it pointed to
+// becomes dead. It runs under the write lock of the index.
+func (db *Db) removeLocation(key string) {
+	if old, ok := db.index.get(key); ok {
+		db.index.remove(key)
+		db.addLive(old.segmentID, -int64(old.size))
+	}
+}
+
+func (s segmentSpace) stats(id int) SegmentStats {
+	return SegmentStats{
+		ID:          id,
+		Size:        s.size,
+		LiveBytes:   s.live,
+		DeadBytes:   s.size - s.live,
+		Reclaimable: max(s.size-s.live-s.pinned, 0),
+	}
+}
+
+func (db *Db) addLive(id int, n int64) {
+	space := db.space[id]
+	space.live += n
+	db.space[id] = space
+}
+
+func (db *Db) addSize(id int, n int64) {
+	space := db.space[id]
+	space.size += n
+	db.space[id] = space
+}
+
+// Stats returns the statistics of the database.
+func (db *Db) Stats() Stats {
+	db.indexMutex.RLock()
+	stats := Stats{Keys: db.index.len()}
+	for id, space := range db.space {
+		stats.Segments = append(stats.Segments, space.stats(id))
+	}
+	db.indexMutex.RUnlock()
+
+	sort.Slice(stats.Segments, func(i, j int) bool { return stats.Segments[i].ID < stats.Segments[j].ID })
+	for _, s := range stats.Segments {
+		stats.LiveBytes += s.LiveBytes
+		stats.DeadBytes += s.DeadBytes
+	}
+	stats.Merges = db.merges.Load()
+	stats.MergeDuration = time.Duration(db.mergeNanos.Load())
+	stats.LastMergeDuration = time.Duration(db.lastMergeNanos.Load())
+	stats.WriteQueue = len(db.putChan)
+	stats.Syncs = db.syncCount.Load()
+	if last := db.lastSync.Load(); last != 0 {
+		stats.LastSync = time.Unix(0, last)
+	}
+	stats.Cache = db.CacheStats()
+	return stats
+}
@@ -0,0 +1,96 @@
+package datastore
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// checkSpace compares the space tracked by Stats with what the index and
+// the segment files say.
+func checkSpace(t *testing.T, db *Db) {
+	t.Helper()
+	want := make(map[int]int64)
+	db.indexMutex.RLock()
+	db.index.ascend("", func(key string, loc recordLocation) bool {
+		want[loc.segmentID] += int64(loc.size)
+		return true
+	})
+	db.indexMutex.RUnlock()
+
+	stats := db.Stats()
+	var total int64
+	for _, s := range stats.Segments {
+		info, err := os.Stat(db.segmentPath(s.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Size != info.Size() || s.LiveBytes != want[s.ID] || s.DeadBytes != s.Size-s.LiveBytes {
+			t.Errorf("segment %d: %+v, want size %d and %d live bytes", s.ID, s, info.Size(), want[s.ID])
+		}
+		total += s.Size
+	}
+	if size, _ := db.Size(); stats.LiveBytes+stats.DeadBytes != total || total != size {
+		t.Errorf("Stats counts %d live and %d dead bytes, the segments have %d, Size is %d", stats.LiveBytes, stats.DeadBytes, total, size)
+	}
+}
+
+func TestStats(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 200, MergeThreshold: 100, Sync: SyncPolicy{Mode: SyncAlways}}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	for i := 0; i < 20; i++ {
+		if err := db.Put(string(rune('a'+i%5)), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	var batch WriteBatch
+	batch.Put("b", "batched")
+	batch.Put("f", "batched")
+	batch.Delete("c")
+	if err := db.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+	checkSpace(t, db)
+
+	stats := db.Stats()
+	if stats.Keys != 4 || len(stats.Segments) < 2 || stats.DeadBytes <= stats.LiveBytes {
+		t.Errorf("Stats after overwrites = %+v", stats)
+	}
+	if stats.Syncs == 0 || time.Since(stats.LastSync) > time.Minute {
+		t.Errorf("Stats has %d syncs, the last at %v", stats.Syncs, stats.LastSync)
+	}
+
+	if err := db.MergeSegments(); err != nil {
+		t.Fatal(err)
+	}
+	checkSpace(t, db)
+	merged := db.Stats()
+	if merged.Merges != 1 || merged.LastMergeDuration <= 0 || merged.MergeDuration != merged.LastMergeDuration {
+		t.Errorf("Stats after a merge = %+v", merged)
+	}
+	if merged.DeadBytes >= stats.DeadBytes || merged.LiveBytes != stats.LiveBytes {
+		t.Errorf("merge left %d live and %d dead bytes, had %d and %d", merged.LiveBytes, merged.DeadBytes, stats.LiveBytes, stats.DeadBytes)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenWithOptions(tmp, opts); err != nil {
+		t.Fatal(err)
+	}
+	checkSpace(t, db)
+	if reopened := db.Stats(); reopened.LiveBytes != merged.LiveBytes || reopened.Merges != 0 {
+		t.Errorf("Stats after reopening = %+v", reopened)
+	}
+}
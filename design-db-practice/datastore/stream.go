@@ -0,0 +1,413 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// largeRecordSize is the size from which records are not read into memory
+// whole when segments are scanned, see decodeDetached, and values are
+// streamed out of their segment by GetItemStream.
+const largeRecordSize = 1 << 20
+
+// maxMetaSize is the size of the meta section with every field set.
+const maxMetaSize = 1 + 3*8
+
+// streamFilePattern names the files values are staged in by PutStream.
+// Open removes leftovers.
+const streamFilePattern = "stream-*.tmp"
+
+// PutStream sets the key to the value read from r, which has size bytes,
+// or is read to its end if size is -1. The value is copied to disk without
+// being held in memory, and is not compressed. If the Db encrypts, records
+// are sealed whole, so the value is read into memory first.
+func (db *Db) PutStream(key string, r io.Reader, size int64) error {
+	_, err := db.putStream(entry{key: key}, r, size, nil)
+	return err
+}
+
+// PutStreamWithTTL is PutStream for a value that expires after ttl.
+func (db *Db) PutStreamWithTTL(key string, r io.Reader, size int64, ttl time.Duration) error {
+	e, err := entryWithTTL(key, "", ttl)
+	if err != nil {
+		return err
+	}
+	_, err = db.putStream(e, r, size, nil)
+	return err
+}
+
+// PutStreamIf is PutIf for a value read from r like by PutStream. The
+// condition is checked once the value is read.
+func (db *Db) PutStreamIf(key string, r io.Reader, size int64, cond Condition) (uint64, error) {
+	return db.putStream(entry{key: key}, r, size, &cond)
+}
+
+// PutStreamIfWithTTL is PutStreamIf for a value that expires after ttl.
+func (db *Db) PutStreamIfWithTTL(key string, r io.Reader, size int64, ttl time.Duration, cond Condition) (uint64, error) {
+	e, err := entryWithTTL(key, "", ttl)
+	if err != nil {
+		return 0, err
+	}
+	return db.putStream(e, r, size, &cond)
+}
+
+func (db *Db) putStream(e entry, r io.Reader, size int64, cond *Condition) (uint64, error) {
+	// The size of a record has to fit its 4 byte field.
+	limit := int64(math.MaxUint32 - entryFixedSize - maxMetaSize - len(e.key))
+	if size > limit {
+		return 0, fmt.Errorf("value of %d bytes is too large, the limit is %d", size, limit)
+	}
+	if size < 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+
+	req := entryWithAck{entry: e, cond: cond}
+	var version uint64
+	req.version = &version
+	if db.cipher.encrypts() {
+		value, err := readStream(r, size)
+		if err != nil {
+			return 0, err
+		}
+		if int64(len(value)) > limit {
+			return 0, fmt.Errorf("value is too large, the limit is %d bytes", limit)
+		}
+		req.entry.value = value
+		err = db.submit(req)
+		return version, err
+	}
+
+	f, err := os.CreateTemp(db.dir, streamFilePattern)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	// Staging the value first keeps the write loop from waiting on r.
+	n, err := copyStream(bufio.NewWriter(f), r, size)
+	if err != nil {
+		return 0, err
+	}
+	if n > limit {
+		return 0, fmt.Errorf("value is too large, the limit is %d bytes", limit)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	req.stream, req.streamSize = f, n
+	err = db.submit(req)
+	return version, err
+}
+
+// copyStream copies size bytes from r to w, or all of r if size is -1,
+// and flushes w.
+func copyStream(w *bufio.Writer, r io.Reader, size int64) (int64, error) {
+	var n int64
+	var err error
+	if size < 0 {
+		n, err = io.Copy(w, r)
+	} else if n, err = io.CopyN(w, r, size); errors.Is(err, io.EOF) {
+		err = fmt.Errorf("value ended after %d of %d bytes: %w", n, size, io.ErrUnexpectedEOF)
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, w.Flush()
+}
+
+func readStream(r io.Reader, size int64) (string, error) {
+	var value strings.Builder
+	if size > 0 {
+		value.Grow(int(size))
+	}
+	w := bufio.NewWriter(&value)
+	if _, err := copyStream(w, r, size); err != nil {
+		return "", err
+	}
+	return value.String(), nil
+}
+
+// encodeStream writes the record of e with the value read from r, which
+// has vl bytes, to w and returns its size. It is Encode for a value that
+// is not in memory.
+func (e *entry) encodeStream(w io.Writer, r io.Reader, vl int64) (int64, error) {
+	meta := e.encodeMeta()
+	size := entryFixedSize + int64(len(e.key)) + vl + int64(len(meta))
+	head := make([]byte, 8, 12+len(e.key))
+	binary.LittleEndian.PutUint32(head, uint32(size))
+	binary.LittleEndian.PutUint32(head[4:], uint32(len(e.key)))
+	head = append(head, e.key...)
+	head = binary.LittleEndian.AppendUint32(head, uint32(vl))
+
+	h := crc32.New(castagnoli)
+	bw := bufio.NewWriterSize(io.MultiWriter(w, h), 64*1024)
+	bw.Write(head)
+	if _, err := io.CopyN(bw, r, vl); err != nil {
+		return 0, fmt.Errorf("cannot copy value: %w", err)
+	}
+	bw.Write(meta)
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	e.checksum = h.Sum32()
+	if _, err := w.Write(binary.LittleEndian.AppendUint32(nil, e.checksum)); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// decodeDetached decodes a record of the given size from in without
+// keeping its value: the value is only read through to check the
+// checksum, and e is marked detached. Like Decode, it reports a checksum
+// mismatch before anything else, so it reads the whole record even if
+// the lengths in it are broken.
+func (e *entry) decodeDetached(in *bufio.Reader, size int64) (int, error) {
+	h := crc32.New(castagnoli)
+	body := &io.LimitedReader{R: io.TeeReader(in, h), N: size - checksumSize}
+	var key, meta []byte
+	err := func() error {
+		var head [8]byte
+		if _, err := io.ReadFull(body, head[:]); err != nil {
+			return err
+		}
+		kl := int64(binary.LittleEndian.Uint32(head[4:]))
+		if kl > body.N-4 {
+			return fmt.Errorf("key length %d exceeds record size %d", kl, size)
+		}
+		key = make([]byte, kl+4)
+		if _, err := io.ReadFull(body, key); err != nil {
+			return err
+		}
+		vl := int64(binary.LittleEndian.Uint32(key[kl:]))
+		key = key[:kl]
+		if vl > body.N {
+			return fmt.Errorf("value length %d exceeds record size %d", vl, size)
+		}
+		if _, err := io.CopyN(io.Discard, body, vl); err != nil {
+			return err
+		}
+		var err error
+		meta, err = io.ReadAll(body)
+		return err
+	}()
+	if _, drainErr := io.Copy(io.Discard, body); err == nil {
+		err = drainErr
+	}
+	read := int(size - checksumSize - body.N)
+	var sum [checksumSize]byte
+	n, sumErr := io.ReadFull(in, sum[:])
+	read += n
+	if sumErr != nil || body.N > 0 {
+		return read, fmt.Errorf("DecodeFromReader, cannot read record: %w", io.ErrUnexpectedEOF)
+	}
+	if h.Sum32() != binary.LittleEndian.Uint32(sum[:]) {
+		return read, fmt.Errorf("DecodeFromReader, cannot decode record: %w", errChecksumMismatch)
+	}
+	if err != nil {
+		return read, fmt.Errorf("DecodeFromReader, cannot decode record: %w", err)
+	}
+	if err := e.decodeMeta(meta); err != nil {
+		return read, fmt.Errorf("DecodeFromReader, cannot decode record: %w", err)
+	}
+	e.key, e.value, e.detached = string(key), "", true
+	e.checksum = h.Sum32()
+	return read, nil
+}
+
+// copyDetached writes the detached record e, read from loc, to w and
+// returns its size. The record is copied as it is, unless it has to be
+// encrypted now, which needs all of it in memory.
+func (db *Db) copyDetached(w io.Writer, e entry, loc recordLocation) (int, error) {
+	db.indexMutex.RLock()
+	s, ok := db.segments[loc.segmentID]
+	db.indexMutex.RUnlock()
+	if !ok {
+		return 0, fmt.Errorf("segment %d is not open", loc.segmentID)
+	}
+	record := io.NewSectionReader(s.file, loc.offset, int64(loc.size))
+	if !db.cipher.encrypts() {
+		n, err := io.Copy(w, record)
+		return int(n), err
+	}
+	data := make([]byte, loc.size)
+	if _, err := io.ReadFull(record, data); err != nil {
+		return 0, err
+	}
+	if err := e.Decode(data); err != nil {
+		return 0, err
+	}
+	n, err := w.Write(db.cipher.encode(e))
+	return n, err
+}
+
+// ItemReader reads a value out of the database along with the metadata of
+// its key. It must be closed.
+type ItemReader struct {
+	// Size is the length of the value.
+	Size    int64
+	Version uint64
+	// ExpiresAt is the zero time for keys without a TTL.
+	ExpiresAt time.Time
+
+	r         io.Reader
+	closeOnce sync.Once
+	release   func()
+}
+
+// GetStream returns a reader of the value of the key. Large values are
+// read from their segment as the reader is read, so the value is not held
+// in memory; a damaged one fails the last Read with an error. The reader
+// must be closed.
+func (db *Db) GetStream(key string) (io.ReadCloser, error) {
+	item, err := db.GetItemStream(key)
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// GetItemStream is GetStream that also returns the metadata of the key.
+// Expired keys are reported as ErrNotFound.
+func (db *Db) GetItemStream(key string) (*ItemReader, error) {
+	db.indexMutex.RLock()
+	loc, ok := db.index.get(key)
+	if !ok || loc.expired(time.Now()) {
+		db.indexMutex.RUnlock()
+		return nil, ErrNotFound
+	}
+	item := &ItemReader{Version: loc.version, release: func() {}}
+	if loc.expiresAt != 0 {
+		item.ExpiresAt = time.Unix(0, loc.expiresAt)
+	}
+	if value, ok := db.cache.get(key); ok {
+		db.indexMutex.RUnlock()
+		item.r, item.Size = strings.NewReader(value), int64(len(value))
+		return item, nil
+	}
+	s, ok := db.segments[loc.segmentID]
+	if !ok {
+		db.indexMutex.RUnlock()
+		return nil, fmt.Errorf("segment %d is not open", loc.segmentID)
+	}
+	// The reference keeps the file readable until the reader is closed,
+	// even if a merge retires the segment meanwhile.
+	s.acquire()
+	db.indexMutex.RUnlock()
+
+	var err error
+	if item.r, item.Size, err = s.openValue(loc, db.cipher); err != nil {
+		s.release()
+		return nil, err
+	}
+	item.release = s.release
+	return item, nil
+}
+
+func (r *ItemReader) Read(p []byte) (int, error) {
+	return r.r.Read(p)
+}
+
+// Close releases the segment the value is read from.
+func (r *ItemReader) Close() error {
+	r.closeOnce.Do(r.release)
+	return nil
+}
+
+// openValue returns a reader of the value of the record at loc and its
+// length. Small records, and the compressed or encrypted ones that can
+// only be decoded whole, are read into memory right away.
+func (s *segment) openValue(loc recordLocation, c *recordCipher) (io.Reader, int64, error) {
+	whole := func() (io.Reader, int64, error) {
+		var value []byte
+		err := s.viewValue(loc, c, func(b []byte) error {
+			value = append([]byte(nil), b...)
+			return nil
+		})
+		return bytes.NewReader(value), int64(len(value)), err
+	}
+	if loc.size < largeRecordSize {
+		return whole()
+	}
+
+	bad := func(err error) (io.Reader, int64, error) {
+		return nil, 0, fmt.Errorf("cannot read record at %d:%d: %w", loc.segmentID, loc.offset, err)
+	}
+	size := int64(loc.size)
+	var fixed [8]byte
+	if _, err := s.file.ReadAt(fixed[:], loc.offset); err != nil {
+		return bad(err)
+	}
+	if int64(binary.LittleEndian.Uint32(fixed[:])) != size {
+		return nil, 0, fmt.Errorf("record at %d:%d does not have the indexed size", loc.segmentID, loc.offset)
+	}
+	kl := int64(binary.LittleEndian.Uint32(fixed[4:]))
+	if kl > size-entryFixedSize {
+		return bad(fmt.Errorf("key length %d exceeds record size %d", kl, size))
+	}
+	head := make([]byte, 12+kl)
+	if _, err := s.file.ReadAt(head, loc.offset); err != nil {
+		return bad(err)
+	}
+	vl := int64(binary.LittleEndian.Uint32(head[8+kl:]))
+	if vl > size-entryFixedSize-kl {
+		return bad(fmt.Errorf("value length %d exceeds record size %d", vl, size))
+	}
+	tail := make([]byte, size-12-kl-vl)
+	if _, err := s.file.ReadAt(tail, loc.offset+12+kl+vl); err != nil {
+		return bad(err)
+	}
+	if meta := tail[:len(tail)-checksumSize]; len(meta) > 0 && meta[0]&(flagCompressed|flagEncrypted) != 0 {
+		return whole()
+	}
+
+	h := crc32.New(castagnoli)
+	h.Write(head)
+	return &checkedValue{
+		r:    io.NewSectionReader(s.file, loc.offset+12+kl, vl),
+		h:    h,
+		tail: tail,
+	}, vl, nil
+}
+
+// checkedValue reads a value out of its record and checks the checksum of
+// the record once the value is read to its end.
+type checkedValue struct {
+	r *io.SectionReader
+	// h has hashed the record up to what r has read so far.
+	h hash.Hash32
+	// tail holds the meta section and the checksum that follow the value.
+	tail []byte
+	// err is the error of the check once it was made.
+	err error
+}
+
+func (v *checkedValue) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	if err == io.EOF {
+		meta, sum := v.tail[:len(v.tail)-checksumSize], v.tail[len(v.tail)-checksumSize:]
+		v.h.Write(meta)
+		v.err = io.EOF
+		if v.h.Sum32() != binary.LittleEndian.Uint32(sum) {
+			v.err = errChecksumMismatch
+		}
+		err = v.err
+	}
+	return n, err
+}
@@ -0,0 +1,280 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// largeValue returns n bytes of noise, so that compression does not
+// shrink it.
+func largeValue(n int) []byte {
+	value := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(value)
+	return value
+}
+
+func readStreamed(t *testing.T, db *Db, key string) []byte {
+	t.Helper()
+	r, err := db.GetStream(key)
+	if err != nil {
+		t.Fatalf("GetStream(%s): %v", key, err)
+	}
+	defer r.Close()
+	value, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading %s: %v", key, err)
+	}
+	return value
+}
+
+func TestStream(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithOptions(tmp, Options{CompressionThreshold: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	w, err := db.Watch("", db.LastSeq())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	large := largeValue(3 * largeRecordSize)
+	if err := db.PutStream("large", bytes.NewReader(large), int64(len(large))); err != nil {
+		t.Fatal(err)
+	}
+	// A reader of unknown length is read to its end.
+	if err := db.PutStream("unsized", strings.NewReader("some value"), -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("small", strings.Repeat("compressible ", 100)); err != nil {
+		t.Fatal(err)
+	}
+	if c := <-w.C; c.Key != "large" || !c.ValueOmitted || c.Value != "" {
+		t.Errorf("change of a streamed value = %+v", c)
+	}
+
+	check := func(t *testing.T) {
+		t.Helper()
+		if got := readStreamed(t, db, "large"); !bytes.Equal(got, large) {
+			t.Errorf("GetStream(large) got %d bytes, want %d", len(got), len(large))
+		}
+		if got := readStreamed(t, db, "unsized"); string(got) != "some value" {
+			t.Errorf("GetStream(unsized) = %q", got)
+		}
+		// Compressed values are read whole and streamed from memory.
+		if got := readStreamed(t, db, "small"); string(got) != strings.Repeat("compressible ", 100) {
+			t.Errorf("GetStream(small) = %q", got)
+		}
+		if got, err := db.Get("large"); err != nil || got != string(large) {
+			t.Errorf("Get(large) = %d bytes, %v", len(got), err)
+		}
+		item, err := db.GetItemStream("large")
+		if err != nil {
+			t.Fatal(err)
+		}
+		item.Close()
+		if item.Size != int64(len(large)) || item.Version != 1 {
+			t.Errorf("GetItemStream(large) has size %d and version %d", item.Size, item.Version)
+		}
+	}
+	check(t)
+
+	t.Run("short reader", func(t *testing.T) {
+		err := db.PutStream("large", strings.NewReader("short"), 100)
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("PutStream of a short reader = %v, want io.ErrUnexpectedEOF", err)
+		}
+		check(t)
+		if staged, _ := filepath.Glob(filepath.Join(tmp, streamFilePattern)); len(staged) > 0 {
+			t.Errorf("staged values left behind: %v", staged)
+		}
+	})
+
+	t.Run("condition", func(t *testing.T) {
+		_, err := db.PutStreamIf("large", strings.NewReader("value"), 5, IfMissing())
+		if !errors.Is(err, ErrConditionFailed) {
+			t.Errorf("PutStreamIf = %v, want ErrConditionFailed", err)
+		}
+		version, err := db.PutStreamIf("unsized", strings.NewReader("some value"), -1, IfVersion(1))
+		if err != nil || version != 2 {
+			t.Errorf("PutStreamIf = %d, %v, want version 2", version, err)
+		}
+	})
+
+	t.Run("reopen and merge", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// Small segments seal the large record on its own.
+		if db, err = OpenWithOptions(tmp, Options{SegmentSize: 1024}); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+		if err := db.Put("next", "value"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.MergeSegments(); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = Open(tmp); err != nil {
+			t.Fatal(err)
+		}
+		check(t)
+	})
+}
+
+func TestStreamDetectsCorruption(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	large := largeValue(2 * largeRecordSize)
+	if err := db.PutStream("large", bytes.NewReader(large), int64(len(large))); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.OpenFile(db.segmentPath(0), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{large[1000] ^ 0xff}, segmentHeaderSize+12+5+1000); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	r, err := db.GetStream("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); !errors.Is(err, errChecksumMismatch) {
+		t.Errorf("reading a damaged value = %v, want errChecksumMismatch", err)
+	}
+
+	var e entry
+	data, err := os.ReadFile(db.segmentPath(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := data[segmentHeaderSize:]
+	n, err := e.DecodeFromReader(bufio.NewReader(bytes.NewReader(record)))
+	if !errors.Is(err, errChecksumMismatch) || n != len(record) {
+		t.Errorf("DecodeFromReader of a damaged large record = %d, %v, want %d, errChecksumMismatch", n, err, len(record))
+	}
+}
+
+func TestStreamEncrypted(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{EncryptionKey: bytes.Repeat([]byte{1}, 32)}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	large := largeValue(2 * largeRecordSize)
+	if err := db.PutStream("large", bytes.NewReader(large), -1); err != nil {
+		t.Fatal(err)
+	}
+	if got := readStreamed(t, db, "large"); !bytes.Equal(got, large) {
+		t.Errorf("GetStream(large) got %d bytes, want %d", len(got), len(large))
+	}
+
+	// Open has to read the large encrypted record whole to decrypt it.
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = OpenWithOptions(tmp, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := readStreamed(t, db, "large"); !bytes.Equal(got, large) {
+		t.Errorf("GetStream(large) after reopening got %d bytes, want %d", len(got), len(large))
+	}
+}
+
+func TestApplyStream(t *testing.T) {
+	leader, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = leader.Close()
+	})
+	follower, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = follower.Close()
+	})
+
+	large := largeValue(3 * largeRecordSize)
+	if err := leader.PutStream("large", bytes.NewReader(large), int64(len(large))); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Put("small", "value"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := leader.OpenLog(LogPosition{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for {
+		record, size, err := r.NextReader()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := follower.ApplyStream(record, size); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := readStreamed(t, follower, "large"); !bytes.Equal(got, large) {
+		t.Errorf("follower GetStream(large) got %d bytes, want %d", len(got), len(large))
+	}
+	if got, err := follower.Get("small"); err != nil || got != "value" {
+		t.Errorf("follower Get(small) = %q, %v", got, err)
+	}
+	if staged, _ := filepath.Glob(filepath.Join(follower.dir, streamFilePattern)); len(staged) > 0 {
+		t.Errorf("staged records left behind: %v", staged)
+	}
+
+	// A record cut short is not applied.
+	r, err = leader.OpenLog(LogPosition{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	record, size, err := r.NextReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := follower.ApplyStream(io.LimitReader(record, size/2), size); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("ApplyStream of a short record = %v, want io.ErrUnexpectedEOF", err)
+	}
+}
@@ -0,0 +1,34 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+)
+
+// PutWithTTL sets the key to value for the given time. Once it passes, the
+// key reads as missing and the next merge drops it.
+func (db *Db) PutWithTTL(key, value string, ttl time.Duration) error {
+	e, err := entryWithTTL(key, value, ttl)
+	if err != nil {
+		return err
+	}
+	return db.submit(entryWithAck{entry: e})
+}
+
+// PutIfWithTTL is PutIf for a value that expires after ttl.
+func (db *Db) PutIfWithTTL(key, value string, ttl time.Duration, cond Condition) (uint64, error) {
+	e, err := entryWithTTL(key, value, ttl)
+	if err != nil {
+		return 0, err
+	}
+	var version uint64
+	err = db.submit(entryWithAck{entry: e, cond: &cond, version: &version})
+	return version, err
+}
+
+func entryWithTTL(key, value string, ttl time.Duration) (entry, error) {
+	if ttl <= 0 {
+		return entry{}, fmt.Errorf("ttl must be positive, got %v", ttl)
+	}
+	return entry{key: key, value: value, expiresAt: time.Now().Add(ttl).UnixNano()}, nil
+}
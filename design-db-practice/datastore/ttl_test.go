@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPutWithTTL(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 60}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	const ttl = 50 * time.Millisecond
+	if err := db.PutWithTTL("session", "data", ttl); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("long", "data", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutWithTTL("bad", "data", 0); err == nil {
+		t.Error("PutWithTTL accepted a zero ttl")
+	}
+
+	item, err := db.GetItem("session")
+	if err != nil {
+		t.Fatalf("GetItem before expiry: %v", err)
+	}
+	if remaining := time.Until(item.ExpiresAt); remaining <= 0 || remaining > ttl {
+		t.Errorf("remaining ttl = %v, want within (0, %v]", remaining, ttl)
+	}
+	if item, _ := db.GetItem("long"); item.ExpiresAt.IsZero() {
+		t.Error("ExpiresAt is not set for a key with a ttl")
+	}
+
+	time.Sleep(ttl + 10*time.Millisecond)
+	if _, err := db.Get("session"); err != ErrNotFound {
+		t.Errorf("Get after expiry = %v, want ErrNotFound", err)
+	}
+	if _, err := db.Get("long"); err != nil {
+		t.Errorf("Get(long): %v", err)
+	}
+
+	t.Run("expired key is new again", func(t *testing.T) {
+		version, err := db.PutIf("session", "fresh", IfMissing())
+		if err != nil {
+			t.Fatalf("PutIf(IfMissing) on an expired key: %v", err)
+		}
+		if version != 1 {
+			t.Errorf("version after expiry = %d, want 1", version)
+		}
+		if err := db.PutWithTTL("session", "data", ttl); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(ttl + 10*time.Millisecond)
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenWithOptions(tmp, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Get("session"); err != ErrNotFound {
+			t.Errorf("expired key after reopen = %v, want ErrNotFound", err)
+		}
+		if _, err := db.Get("long"); err != nil {
+			t.Errorf("Get(long) after reopen: %v", err)
+		}
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		if err := db.Put("filler", "v"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.MergeSegments(); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(tmp, fmt.Sprintf(segmentFileFormat, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "session") {
+			t.Error("merged segment still contains the expired key")
+		}
+		if !strings.Contains(string(data), "long") {
+			t.Error("merged segment lost a key that has not expired")
+		}
+	})
+}
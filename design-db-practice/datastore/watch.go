@@ -0,0 +1,161 @@
+package datastore
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrWatchGap is returned when the changes a watcher asks for are no
+// longer kept in memory, either because it resumes from too far back or
+// because it fell behind. The watcher has to read the current values
+// again and watch from LastSeq.
+var ErrWatchGap = errors.New("changes are no longer available")
+
+// Change describes a put or a delete of a key.
+type Change struct {
+	// Seq numbers the writes of a Db in the order they were made.
+	Seq     uint64
+	Key     string
+	Value   string
+	Version uint64
+	Deleted bool
+	// ValueOmitted is set for a value put by PutStream, which is not kept
+	// in memory; Value is empty then and GetStream reads the value.
+	ValueOmitted bool
+}
+
+// changeHistory keeps the most recent changes, oldest first.
+type changeHistory struct {
+	changes []Change
+	limit   int
+	// floor is the sequence number of the latest change that is no longer
+	// kept, so changes after it can be served.
+	floor uint64
+}
+
+func (h *changeHistory) add(e entry) {
+	if e.seq == 0 {
+		return
+	}
+	c := Change{Seq: e.seq, Key: e.key, Version: e.version, Deleted: e.isTombstone(), ValueOmitted: e.detached}
+	if !c.Deleted && !c.ValueOmitted {
+		// The value was compressed on the write loop a moment ago, so it
+		// inflates cleanly.
+		c.Value, _ = e.plainValue()
+	}
+	h.changes = append(h.changes, c)
+	// The slice is compacted once it holds twice the limit, so adding
+	// stays amortised constant time.
+	if len(h.changes) >= 2*h.limit {
+		drop := len(h.changes) - h.limit
+		h.floor = h.changes[drop-1].Seq
+		h.changes = append([]Change(nil), h.changes[drop:]...)
+	}
+}
+
+// since returns up to n changes of keys with the prefix made after seq,
+// and the sequence number to continue from.
+func (h *changeHistory) since(seq uint64, prefix string, n int) ([]Change, uint64, error) {
+	if seq < h.floor {
+		return nil, seq, ErrWatchGap
+	}
+	i := sort.Search(len(h.changes), func(i int) bool { return h.changes[i].Seq > seq })
+	var res []Change
+	for ; i < len(h.changes) && len(res) < n; i++ {
+		c := h.changes[i]
+		seq = c.Seq
+		if strings.HasPrefix(c.Key, prefix) {
+			res = append(res, c)
+		}
+	}
+	return res, seq, nil
+}
+
+// LastSeq returns the sequence number of the latest write.
+func (db *Db) LastSeq() uint64 {
+	db.indexMutex.RLock()
+	defer db.indexMutex.RUnlock()
+	return db.lastSeq
+}
+
+// Watcher delivers the changes of the keys it watches in order.
+type Watcher struct {
+	// C receives the changes. It is closed when the watcher stops; Err
+	// tells why.
+	C <-chan Change
+
+	c         chan Change
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+// Watch returns a watcher of the changes to keys with the prefix made
+// after the write with sequence number fromSeq. Passing LastSeq watches
+// for new changes only. A watcher must be closed.
+func (db *Db) Watch(prefix string, fromSeq uint64) (*Watcher, error) {
+	db.indexMutex.RLock()
+	if db.segments == nil {
+		db.indexMutex.RUnlock()
+		return nil, errClosed
+	}
+	if fromSeq < db.changes.floor {
+		db.indexMutex.RUnlock()
+		return nil, ErrWatchGap
+	}
+	db.indexMutex.RUnlock()
+
+	c := make(chan Change)
+	w := &Watcher{C: c, c: c, done: make(chan struct{})}
+	go w.run(db, prefix, fromSeq)
+	return w, nil
+}
+
+func (w *Watcher) run(db *Db, prefix string, seq uint64) {
+	defer close(w.c)
+	for {
+		db.indexMutex.RLock()
+		changes, next, err := db.changes.since(seq, prefix, iteratorBatchSize)
+		signal := db.logSignal
+		db.indexMutex.RUnlock()
+		if err != nil {
+			w.err = err
+			return
+		}
+		seq = next
+
+		for _, c := range changes {
+			select {
+			case w.c <- c:
+			case <-w.done:
+				return
+			}
+		}
+		if len(changes) > 0 {
+			continue
+		}
+		select {
+		case <-signal:
+		case <-w.done:
+			return
+		case <-db.closeChan:
+			w.err = errClosed
+			return
+		}
+	}
+}
+
+// Err returns the reason C was closed: ErrWatchGap if the watcher fell
+// too far behind, or nil after Close.
+func (w *Watcher) Err() error {
+	return w.err
+}
+
+// Close stops the watcher. C is closed soon after.
+func (w *Watcher) Close() {
+	w.closeOnce.Do(func() {
+		close(w.done)
+	})
+}
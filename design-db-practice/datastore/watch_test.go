@@ -0,0 +1,115 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func nextChange(t *testing.T, w *Watcher) Change {
+	t.Helper()
+	select {
+	case c, ok := <-w.C:
+		if !ok {
+			t.Fatalf("watcher stopped: %v", w.Err())
+		}
+		return c
+	case <-time.After(time.Second):
+		t.Fatal("no change delivered")
+	}
+	return Change{}
+}
+
+func TestWatch(t *testing.T) {
+	tmp := t.TempDir()
+	opts := Options{SegmentSize: 100, WatchHistory: 4}
+	db, err := OpenWithOptions(tmp, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	start := db.LastSeq()
+	w, err := db.Watch("user/", start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := db.Put("user/1", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("other", "x"); err != nil {
+		t.Fatal(err)
+	}
+	var batch WriteBatch
+	batch.Put("user/2", "b")
+	batch.Delete("user/1")
+	if err := db.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Change{
+		{Seq: start + 1, Key: "user/1", Value: "a", Version: 1},
+		{Seq: start + 3, Key: "user/2", Value: "b", Version: 1},
+		{Seq: start + 4, Key: "user/1", Deleted: true},
+	}
+	for _, c := range want {
+		if got := nextChange(t, w); got != c {
+			t.Errorf("change = %+v, want %+v", got, c)
+		}
+	}
+	if db.LastSeq() != start+4 {
+		t.Errorf("LastSeq = %d, want %d", db.LastSeq(), start+4)
+	}
+
+	t.Run("resume", func(t *testing.T) {
+		w, err := db.Watch("", start+2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		if c := nextChange(t, w); c.Seq != start+3 {
+			t.Errorf("resumed at seq %d, want %d", c.Seq, start+3)
+		}
+	})
+
+	t.Run("gap", func(t *testing.T) {
+		for i := 0; i < 2*opts.WatchHistory; i++ {
+			if err := db.Put("filler", fmt.Sprint(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := db.Watch("", start); !errors.Is(err, ErrWatchGap) {
+			t.Errorf("Watch from a dropped seq = %v, want ErrWatchGap", err)
+		}
+	})
+
+	t.Run("seq survives reopen", func(t *testing.T) {
+		if err := db.Delete("filler"); err != nil {
+			t.Fatal(err)
+		}
+		last := db.LastSeq()
+		// Seal the segment so that the merge drops the tombstone.
+		if err := db.Backup(io.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.MergeSegments(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		db, err = OpenWithOptions(tmp, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if db.LastSeq() != last {
+			t.Errorf("LastSeq after reopen = %d, want %d", db.LastSeq(), last)
+		}
+	})
+}